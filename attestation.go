@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// attestation is evidence, e.g. for SOC 2 or ISO 27001 audits, that the
+// organizations in the catalog were backed up at least every policy interval
+// during the retention period. It's signed with --signing-key.
+type attestation struct {
+	GeneratedAt   time.Time                 `json:"generated_at"`
+	Generator     string                    `json:"generator"`
+	Destination   string                    `json:"destination"`
+	Policy        attestationPolicy         `json:"policy"`
+	Compliant     bool                      `json:"compliant"`
+	Organizations []organizationAttestation `json:"organizations"`
+}
+
+// attestationPolicy is the backup policy attested.
+type attestationPolicy struct {
+	Interval  string    `json:"interval"`
+	Retention string    `json:"retention"`
+	Since     time.Time `json:"since"`
+}
+
+// organizationAttestation is the attestation of an organization's backups
+// during the retention period, Issues explain why it isn't compliant.
+type organizationAttestation struct {
+	Organization      string            `json:"organization"`
+	Compliant         bool              `json:"compliant"`
+	Backups           int               `json:"backups"`
+	LargestGapSeconds float64           `json:"largest_gap_seconds"`
+	Issues            []string          `json:"issues,omitempty"`
+	Archives          []attestedArchive `json:"archives"`
+}
+
+// attestedArchive is a successful backup during the retention period.
+type attestedArchive struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"started_at"`
+	Status    string    `json:"status"`
+	Path      string    `json:"path"`
+	Bytes     uint64    `json:"bytes"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Locations []string  `json:"locations,omitempty"`
+
+	// Present if the archive is still in the destination
+	Present bool `json:"present"`
+}
+
+// attest writes a signed attestation of the backups in the catalog against
+// --policy-interval and --policy-retention to the destination, compliant is
+// false if any organization isn't.
+func attest() (compliant bool, err error) {
+	if signingKey == "" {
+		return false, fmt.Errorf("report attestation requires --signing-key")
+	}
+
+	key, err := readSigningKey(signingKey)
+	if err != nil {
+		return false, err
+	}
+
+	entries, err := readCatalog(destination, "")
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	a := &attestation{
+		GeneratedAt: now,
+		Generator:   "ghec-backup " + version,
+		Destination: destination,
+		Policy: attestationPolicy{
+			Interval:  policyInterval.String(),
+			Retention: policyRetention.String(),
+			Since:     now.Add(-policyRetention),
+		},
+		Compliant: true,
+	}
+
+	if abs, err := filepath.Abs(destination); err == nil {
+		a.Destination = abs
+	}
+
+	byOrganization := map[string][]catalogEntry{}
+	for _, e := range entries {
+		byOrganization[e.Organization] = append(byOrganization[e.Organization], e)
+	}
+
+	for org, entries := range byOrganization {
+		o := attestOrganization(org, entries, a.Policy.Since, now)
+		a.Compliant = a.Compliant && o.Compliant
+		a.Organizations = append(a.Organizations, o)
+	}
+
+	if len(a.Organizations) == 0 {
+		return false, fmt.Errorf("no backups in %s", catalogPath(destination))
+	}
+
+	sort.Slice(a.Organizations, func(i, j int) bool { return a.Organizations[i].Organization < a.Organizations[j].Organization })
+
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	b = append(b, '\n')
+
+	path := filepath.Join(destination, fmt.Sprintf("attestation.%d.json", now.Unix()))
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return false, err
+	}
+
+	// detached, verify with: openssl pkeyutl -verify -pubin -inkey <public key> -rawin -in <path> -sigfile <path>.sig
+	sig := ed25519.Sign(key, b)
+	if err := ioutil.WriteFile(path+".sig", sig, 0644); err != nil {
+		return false, err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Organization\tBackups\tLargest gap\tCompliant")
+	for _, o := range a.Organizations {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%t\n", o.Organization, o.Backups, (time.Duration(o.LargestGapSeconds) * time.Second).Round(time.Minute), o.Compliant)
+	}
+	tw.Flush()
+
+	for _, o := range a.Organizations {
+		for _, issue := range o.Issues {
+			fmt.Println(colorize(colorRed, o.Organization+": "+issue))
+		}
+	}
+
+	fmt.Printf("\nWrote attestation to %s, signed in %s\n", path, path+".sig")
+
+	return a.Compliant, nil
+}
+
+// attestOrganization attests the backups of org in entries, oldest first,
+// between since and now.
+func attestOrganization(org string, entries []catalogEntry, since, now time.Time) organizationAttestation {
+	o := organizationAttestation{Organization: org, Archives: []attestedArchive{}}
+
+	// the gaps between since, every successful backup, and now
+	last := since
+	gap := func(until time.Time) {
+		d := until.Sub(last)
+		if d.Seconds() > o.LargestGapSeconds {
+			o.LargestGapSeconds = d.Seconds()
+		}
+		if d > policyInterval {
+			o.Issues = append(o.Issues, fmt.Sprintf("no successful backup for %s between %s and %s",
+				d.Round(time.Minute), last.Format(time.RFC3339), until.Format(time.RFC3339)))
+		}
+	}
+
+	for _, e := range entries {
+		if e.StartedAt.Before(since) || e.Archive == "" || e.Status == "failed" {
+			continue
+		}
+
+		archive := attestedArchive{
+			ID:        e.id(),
+			StartedAt: e.StartedAt,
+			Status:    e.Status,
+			Path:      e.Archive,
+			Bytes:     e.Bytes,
+			SHA256:    e.SHA256,
+			Locations: e.Locations,
+		}
+
+		if fi, err := os.Stat(e.Archive); err == nil && uint64(fi.Size()) == e.Bytes {
+			archive.Present = true
+		}
+
+		if !archive.Present && len(e.Locations) == 0 {
+			o.Issues = append(o.Issues, fmt.Sprintf("archive %s is neither in the destination nor in a storage", archive.ID))
+		}
+		if e.SHA256 == "" {
+			o.Issues = append(o.Issues, fmt.Sprintf("archive %s has no checksum", archive.ID))
+		}
+
+		gap(e.StartedAt)
+		last = e.StartedAt
+
+		o.Archives = append(o.Archives, archive)
+	}
+	gap(now)
+
+	o.Backups = len(o.Archives)
+	// the gaps don't catch it if the interval is longer than the retention
+	if o.Backups == 0 && len(o.Issues) == 0 {
+		o.Issues = append(o.Issues, fmt.Sprintf("no successful backup since %s", since.Format(time.RFC3339)))
+	}
+	o.Compliant = len(o.Issues) == 0
+
+	return o
+}
+
+// readSigningKey reads the PKCS #8 PEM Ed25519 private key at path, e.g.
+// created with: openssl genpkey -algorithm ed25519 -out key.pem
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM private key", path)
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %T isn't an Ed25519 key", path, k)
+	}
+
+	return key, nil
+}
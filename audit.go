@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/stoe/ghec-backup/pkg/backup"
+)
+
+// audit actions
+const (
+	auditMigrationStarted   = "migration_started"
+	auditRepositoriesLocked = "repositories_locked"
+	auditRepositoryUnlocked = "repository_unlocked"
+	auditMigrationDeleted   = "migration_deleted"
+	auditMigrationAbandoned = "migration_abandoned"
+	auditArchiveUploaded    = "archive_uploaded"
+	auditArchiveDownloaded  = "archive_downloaded"
+	auditHoldSet            = "hold_set"
+	auditHoldReleased       = "hold_released"
+)
+
+var auditMu sync.Mutex
+
+// audit appends a privileged action to the --audit-log as a JSON line, so
+// there is evidence of what was done to the organization and when.
+func audit(action, org string, fields map[string]interface{}) {
+	if auditLog == "" {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"time":         time.Now().UTC().Format(time.RFC3339),
+		"action":       action,
+		"organization": org,
+		"pid":          os.Getpid(),
+	}
+
+	if host, err := os.Hostname(); err == nil {
+		entry["host"] = host
+	}
+
+	for k, v := range fields {
+		entry[k] = v
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(entry)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if err != nil {
+		printError(fmt.Errorf("audit log: %s", err))
+	}
+}
+
+// auditEvent records the privileged actions of a backup of org.
+func auditEvent(org string, lock bool, e backup.Event) {
+	switch e.Type {
+	case backup.MigrationStarted:
+		audit(auditMigrationStarted, org, map[string]interface{}{"migration_id": e.MigrationID, "repositories": e.Repositories})
+		if lock {
+			audit(auditRepositoriesLocked, org, map[string]interface{}{"migration_id": e.MigrationID, "repositories": e.Repositories})
+		}
+	case backup.MigrationAbandoned:
+		audit(auditMigrationAbandoned, org, map[string]interface{}{"migration_id": e.MigrationID})
+	case backup.DownloadComplete:
+		audit(auditArchiveDownloaded, org, map[string]interface{}{"migration_id": e.MigrationID, "file": e.Path, "bytes": e.Bytes})
+	case backup.RepositoryUnlocked:
+		audit(auditRepositoryUnlocked, org, map[string]interface{}{"migration_id": e.MigrationID, "repository": e.Repository})
+	case backup.MigrationDeleted:
+		audit(auditMigrationDeleted, org, map[string]interface{}{"migration_id": e.MigrationID})
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// archiveInfo describes a backup archive in the destination.
+type archiveInfo struct {
+	Organization string    `json:"organization,omitempty"`
+	Path         string    `json:"path"`
+	Bytes        uint64    `json:"bytes"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// listArchives returns the archives in dest, newest first, in the
+// <dest>/<org>/<date>/ layout or directly in dest.
+func listArchives(dest string) ([]archiveInfo, error) {
+	var archives []archiveInfo
+
+	for _, pattern := range []string{
+		filepath.Join(dest, "*", "*", "backup.*.tar.gz"),
+		filepath.Join(dest, "backup.*.tar.gz"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil {
+				continue
+			}
+
+			a := archiveInfo{Path: m, Bytes: uint64(fi.Size()), CreatedAt: fi.ModTime().UTC()}
+
+			// backup.<org>.<unix>.tar.gz, older archives have no organization
+			if parts := strings.Split(strings.TrimSuffix(filepath.Base(m), ".tar.gz"), "."); len(parts) == 3 {
+				a.Organization = parts[1]
+			}
+
+			archives = append(archives, a)
+		}
+	}
+
+	sort.Slice(archives, func(i, j int) bool { return archives[i].CreatedAt.After(archives[j].CreatedAt) })
+
+	return archives, nil
+}
+
+// catalogEntry is a run recorded in the catalog, one JSON object per line in
+// <destination>/catalog.jsonl.
+type catalogEntry struct {
+	Organization    string    `json:"organization"`
+	Status          string    `json:"status"`
+	Labels          []string  `json:"labels,omitempty"`
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Archive         string    `json:"archive,omitempty"`
+	Bytes           uint64    `json:"bytes,omitempty"`
+	SHA256          string    `json:"sha256,omitempty"`
+	Locations       []string  `json:"locations,omitempty"`
+
+	// Repositories in the archive, not those that failed or are missing
+	Repositories []string `json:"repositories"`
+
+	// HeldSince is set while the backup is on legal hold
+	HeldSince *time.Time `json:"held_since,omitempty"`
+}
+
+// id identifies the backup by its archive, <org>.<timestamp>, empty if the
+// run didn't download one.
+func (e catalogEntry) id() string {
+	if e.Archive == "" {
+		return ""
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(e.Archive), "backup."), ".tar.gz")
+}
+
+// catalogPath is the catalog of the runs backing up to dest.
+func catalogPath(dest string) string {
+	return filepath.Join(dest, "catalog.jsonl")
+}
+
+// appendCatalog records the run of s in the catalog of dest.
+func appendCatalog(dest string, s *Summary) error {
+	e := catalogEntry{
+		Organization:    s.Organization,
+		Status:          s.Status,
+		Labels:          s.Labels,
+		StartedAt:       s.StartedAt,
+		DurationSeconds: s.DurationSeconds,
+		Repositories:    make([]string, 0, len(s.Repositories)),
+	}
+
+	if s.Archive != nil {
+		e.Archive, e.Bytes = s.Archive.Path, s.Archive.Bytes
+		e.SHA256, e.Locations = s.Archive.SHA256, s.Archive.Locations
+	}
+
+	for _, r := range s.Repositories {
+		if r.Status == "exported" {
+			e.Repositories = append(e.Repositories, r.Name)
+		}
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	unlock, err := lockCatalog(dest)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(catalogPath(dest), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// labelPattern are valid --label values
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// readCatalog returns the runs in the catalog of dest, of org only unless
+// it's empty, with all of --label, oldest first.
+func readCatalog(dest, org string) ([]catalogEntry, error) {
+	all, err := readCatalogEntries(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []catalogEntry
+	for _, e := range all {
+		if (org == "" || strings.EqualFold(e.Organization, org)) && hasLabels(e.Labels, labels) {
+			entries = append(entries, e)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartedAt.Before(entries[j].StartedAt) })
+
+	return entries, nil
+}
+
+// readCatalogEntries returns all runs in the catalog of dest in the order
+// they were recorded.
+func readCatalogEntries(dest string) ([]catalogEntry, error) {
+	f, err := os.Open(catalogPath(dest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []catalogEntry
+
+	// lines list all repositories, so they can be longer than bufio's default
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		var e catalogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", catalogPath(dest), line, err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// catalogLockTimeout is how long to wait for another process to finish
+// writing the catalog.
+const catalogLockTimeout = 30 * time.Second
+
+// lockCatalog creates a lock file with our PID next to the catalog of dest,
+// so a run appending to it doesn't race a rewrite, and returns the function
+// removing it. Lock files of processes that are no longer running are
+// replaced.
+func lockCatalog(dest string) (func(), error) {
+	path := catalogPath(dest) + ".lock"
+	deadline := time.Now().Add(catalogLockTimeout)
+
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+
+			return func() { os.Remove(path) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		// the lock is being created if the PID isn't written yet
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && !processRunning(pid) {
+			verbosef("removing stale lock file %s", path)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("could not acquire lock file %s, remove it if it is stale", path)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// updateCatalog applies update to the runs in the catalog of dest and
+// replaces it with the result, holding the catalog lock throughout.
+func updateCatalog(dest string, update func([]catalogEntry) error) error {
+	unlock, err := lockCatalog(dest)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := readCatalogEntries(dest)
+	if err != nil {
+		return err
+	}
+
+	if err := update(entries); err != nil {
+		return err
+	}
+
+	return writeCatalog(dest, entries)
+}
+
+// writeCatalog replaces the catalog of dest with entries, the caller holds
+// the catalog lock.
+func writeCatalog(dest string, entries []catalogEntry) error {
+	var b []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+
+	// write and rename, so the catalog is never left half written
+	tmp := catalogPath(dest) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, catalogPath(dest))
+}
+
+// catalog runs the catalog command action, supported: export, find.
+func catalog(action string) error {
+	switch action {
+	case "find":
+		if len(repos) == 0 {
+			return fmt.Errorf("catalog find requires --repository")
+		}
+
+		if organization == "" {
+			return fmt.Errorf("catalog find requires --organization")
+		}
+
+		entries, err := readCatalog(destination, organization)
+		if err != nil {
+			return err
+		}
+
+		return writeFound(os.Stdout, entries, repos)
+	case "export":
+		entries, err := readCatalog(destination, "")
+		if err != nil {
+			return err
+		}
+
+		if format == "csv" {
+			return writeInventoryCSV(os.Stdout, entries)
+		}
+		return writeInventory(os.Stdout, entries)
+	case "":
+		return fmt.Errorf("catalog requires an action, supported: export, find")
+	default:
+		return fmt.Errorf("unknown catalog action %q, supported: export, find", action)
+	}
+}
+
+// inventoryHeader are the columns of the inventory of all backups
+var inventoryHeader = []string{"id", "started_at", "organization", "status", "repositories", "bytes", "location", "storages", "sha256", "labels", "held_since"}
+
+// inventoryRecord is the inventory row of e.
+func inventoryRecord(e catalogEntry) []string {
+	held := ""
+	if e.HeldSince != nil {
+		held = e.HeldSince.Format(time.RFC3339)
+	}
+
+	return []string{
+		e.id(),
+		e.StartedAt.Format(time.RFC3339),
+		e.Organization,
+		e.Status,
+		strconv.Itoa(len(e.Repositories)),
+		strconv.FormatUint(e.Bytes, 10),
+		e.Archive,
+		strings.Join(e.Locations, " "),
+		e.SHA256,
+		strings.Join(e.Labels, " "),
+		held,
+	}
+}
+
+// writeInventory prints the inventory of all backups in the catalog.
+func writeInventory(w io.Writer, entries []catalogEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tStarted\tOrganization\tStatus\tRepositories\tSize\tLocation\tStorages\tSHA-256\tLabels\tHeld since")
+
+	for _, e := range entries {
+		r := inventoryRecord(e)
+		r[1] = e.StartedAt.Local().Format("2006-01-02 15:04")
+		r[5] = humanize.Bytes(e.Bytes)
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// writeInventoryCSV writes the inventory of all backups in the catalog as
+// CSV, e.g. for auditors.
+func writeInventoryCSV(w io.Writer, entries []catalogEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write(inventoryHeader)
+
+	for _, e := range entries {
+		cw.Write(inventoryRecord(e))
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeFound lists the backups in entries containing any of names, newest
+// first, e.g. to pick the archive to restore a repository from.
+func writeFound(w io.Writer, entries []catalogEntry, names []string) error {
+	type found struct {
+		repository string
+		catalogEntry
+	}
+
+	var matches []found
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		for _, name := range names {
+			for _, r := range entries[i].Repositories {
+				if strings.EqualFold(r, name) {
+					matches = append(matches, found{r, entries[i]})
+				}
+			}
+		}
+	}
+
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"repository", "started_at", "status", "location", "storages", "sha256"})
+
+		for _, m := range matches {
+			cw.Write([]string{m.repository, m.StartedAt.Format(time.RFC3339), m.Status, m.Archive, strings.Join(m.Locations, " "), m.SHA256})
+		}
+
+		cw.Flush()
+		return cw.Error()
+	}
+
+	if len(matches) == 0 {
+		_, err := fmt.Fprintf(w, "No backup of %s contains %s\n", organization, strings.Join(names, ", "))
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Repository\tStarted\tStatus\tLocation\tStorages")
+
+	for _, m := range matches {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", m.repository, m.StartedAt.Local().Format("2006-01-02 15:04"), m.Status, m.Archive, strings.Join(m.Locations, " "))
+	}
+
+	return tw.Flush()
+}
+
+// hasLabels is true if have includes all of want.
+func hasLabels(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
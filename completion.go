@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// shells supported by the completion command
+var shells = []string{"bash", "zsh", "fish", "powershell"}
+
+// flags that take a file path
+var fileFlags = map[string]bool{
+	"config":      true,
+	"token-file":  true,
+	"ca-cert":     true,
+	"client-cert": true,
+	"client-key":  true,
+	"destination": true,
+	"audit-log":   true,
+}
+
+// completion prints the completion script for shell.
+func completion(shell string) error {
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	case "powershell":
+		fmt.Print(powershellCompletion())
+	default:
+		return fmt.Errorf("unsupported shell %q, must be one of %s", shell, strings.Join(shells, ", "))
+	}
+
+	return nil
+}
+
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+
+	return names
+}
+
+func flagNames() (names []string) {
+	pflag.CommandLine.VisitAll(func(f *pflag.Flag) {
+		names = append(names, "--"+f.Name)
+		if f.Shorthand != "" {
+			names = append(names, "-"+f.Shorthand)
+		}
+	})
+
+	return names
+}
+
+func bashCompletion() string {
+	var files []string
+	pflag.CommandLine.VisitAll(func(f *pflag.Flag) {
+		if fileFlags[f.Name] {
+			files = append(files, "--"+f.Name)
+			if f.Shorthand != "" {
+				files = append(files, "-"+f.Shorthand)
+			}
+		}
+	})
+
+	return fmt.Sprintf(`# bash completion for ghec-backup
+_ghec_backup() {
+  local cur="${COMP_WORDS[COMP_CWORD]}"
+  local prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+  case "$prev" in
+    completion)
+      COMPREPLY=($(compgen -W "%s" -- "$cur"))
+      return
+      ;;
+    %s)
+      COMPREPLY=($(compgen -f -- "$cur"))
+      return
+      ;;
+  esac
+
+  if [[ "$cur" == -* ]]; then
+    COMPREPLY=($(compgen -W "%s" -- "$cur"))
+  else
+    COMPREPLY=($(compgen -W "%s" -- "$cur"))
+  fi
+}
+
+complete -F _ghec_backup ghec-backup
+`,
+		strings.Join(shells, " "),
+		strings.Join(files, "|"),
+		strings.Join(flagNames(), " "),
+		strings.Join(commandNames(), " "),
+	)
+}
+
+func zshCompletion() string {
+	var b strings.Builder
+
+	b.WriteString("#compdef ghec-backup\n\n_arguments \\\n")
+
+	cmds := make([]string, len(commands))
+	for i, c := range commands {
+		cmds[i] = fmt.Sprintf("%s\\:%q", c.name, zshEscape(c.usage))
+	}
+	fmt.Fprintf(&b, "  '1: :((%s))' \\\n", strings.Join(cmds, " "))
+	fmt.Fprintf(&b, "  '2: :(%s)' \\\n", strings.Join(shells, " "))
+
+	pflag.CommandLine.VisitAll(func(f *pflag.Flag) {
+		usage := zshEscape(f.Usage)
+
+		action := ""
+		if f.Value.Type() != "bool" {
+			action = ": :"
+			if fileFlags[f.Name] {
+				action = ": :_files"
+			}
+		}
+
+		if f.Shorthand != "" {
+			fmt.Fprintf(&b, "  '(-%s --%s)'{-%s,--%s}'[%s]%s' \\\n", f.Shorthand, f.Name, f.Shorthand, f.Name, usage, action)
+		} else {
+			fmt.Fprintf(&b, "  '--%s[%s]%s' \\\n", f.Name, usage, action)
+		}
+	})
+
+	return strings.TrimSuffix(b.String(), " \\\n") + "\n"
+}
+
+func zshEscape(s string) string {
+	return strings.NewReplacer(
+		"'", `'\''`,
+		"[", `\[`,
+		"]", `\]`,
+	).Replace(s)
+}
+
+func fishCompletion() string {
+	var b strings.Builder
+
+	b.WriteString("# fish completion for ghec-backup\n")
+
+	for _, c := range commands {
+		fmt.Fprintf(&b, "complete -c ghec-backup -n __fish_use_subcommand -f -a %s -d '%s'\n", c.name, fishEscape(c.usage))
+	}
+	fmt.Fprintf(&b, "complete -c ghec-backup -n '__fish_seen_subcommand_from completion' -f -a '%s'\n", strings.Join(shells, " "))
+
+	pflag.CommandLine.VisitAll(func(f *pflag.Flag) {
+		fmt.Fprintf(&b, "complete -c ghec-backup -l %s", f.Name)
+		if f.Shorthand != "" {
+			fmt.Fprintf(&b, " -s %s", f.Shorthand)
+		}
+
+		switch {
+		case fileFlags[f.Name]:
+			b.WriteString(" -r -F")
+		case f.Value.Type() != "bool":
+			b.WriteString(" -r -f")
+		}
+
+		fmt.Fprintf(&b, " -d '%s'\n", fishEscape(f.Usage))
+	})
+
+	return b.String()
+}
+
+func fishEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s)
+}
+
+func powershellCompletion() string {
+	words := append(commandNames(), flagNames()...)
+	words = append(words, shells...)
+
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = "'" + w + "'"
+	}
+
+	return fmt.Sprintf(`# powershell completion for ghec-backup
+Register-ArgumentCompleter -Native -CommandName ghec-backup -ScriptBlock {
+  param($wordToComplete, $commandAst, $cursorPosition)
+
+  @(%s) |
+    Where-Object { $_ -like "$wordToComplete*" } |
+    ForEach-Object { [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_) }
+}
+`, strings.Join(quoted, ", "))
+}
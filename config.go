@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var (
+	// config file names looked up in the config directory, the format is
+	// detected by extension and extensionless files are YAML
+	configNames = []string{
+		".ghec-backup",
+		".ghec-backup.yml",
+		".ghec-backup.yaml",
+		".ghec-backup.json",
+		".ghec-backup.toml",
+	}
+
+	// config file names looked up in the XDG config directory
+	xdgConfigNames = []string{
+		"config.yml",
+		"config.yaml",
+		"config.json",
+		"config.toml",
+	}
+
+	// config keys that are only available as command line flags
+	flagOnlyKeys = map[string]bool{
+		"config":  true,
+		"help":    true,
+		"version": true,
+	}
+
+	// config keys that are not backed by a flag, with their expected type
+	configOnlyKeys = map[string]string{
+		"token":          "string",
+		"token_source":   "map",
+		"hooks":          "map",
+		"plugins":        "map",
+		"serve_token":    "string",
+		"webhook_secret": "string",
+		"sentry_dsn":     "string",
+		"never_backup":   "stringSlice",
+	}
+
+	tokenSourceKeys = map[string]bool{
+		"type":      true,
+		"address":   true,
+		"path":      true,
+		"secret_id": true,
+		"region":    true,
+		"project":   true,
+		"version":   true,
+		"field":     true,
+	}
+
+	// options that can't be combined in a config file
+	exclusiveKeys = []string{"token", "token-file", "token-stdin", "auth", "token_source"}
+
+	// ${VAR} references expanded from the environment
+	envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// configError points to the offending line in the config file.
+type configError struct {
+	path string
+	line int
+	msg  string
+}
+
+func (e *configError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("config %s:%d: %s", e.path, e.line, e.msg)
+	}
+
+	return fmt.Sprintf("config %s: %s", e.path, e.msg)
+}
+
+// readConfig reads and validates the config file from --config, which can be
+// a file or a directory containing .ghec-backup, or else from the current
+// directory or the XDG config directories.
+func readConfig() error {
+	path := ""
+
+	switch fi, err := os.Stat(cfg); {
+	case cfg == "":
+		path = findConfig(".", configNames)
+
+		for _, dir := range xdgConfigDirs() {
+			if path != "" {
+				break
+			}
+			path = findConfig(dir, xdgConfigNames)
+		}
+	case err != nil:
+		return fmt.Errorf("config file %s not found", cfg)
+	case fi.IsDir():
+		if path = findConfig(cfg, configNames); path == "" {
+			return fmt.Errorf("config file .ghec-backup not found in %s", cfg)
+		}
+	default:
+		path = cfg
+	}
+
+	if path == "" {
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// a separate viper instance only holds the config file, no flags or defaults
+	v := viper.New()
+	v.SetConfigType(configType(path))
+	if err := v.ReadConfig(bytes.NewReader(raw)); err != nil {
+		return &configError{path: path, msg: err.Error()}
+	}
+
+	lines := strings.Split(string(raw), "\n")
+	settings := v.AllSettings()
+
+	if err := validateConfig(path, lines, settings); err != nil {
+		return err
+	}
+
+	if err := expandEnv(path, lines, "", settings); err != nil {
+		return err
+	}
+
+	return viper.MergeConfigMap(settings)
+}
+
+// expandEnv replaces ${VAR} references in the string values of the config
+// with their environment values, so configs can be committed without
+// secrets. Keys and comments are left as is and the values aren't parsed
+// again, so a secret can't change the structure of the config.
+func expandEnv(path string, lines []string, key string, value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, sv := range v {
+			s, err := expandEnvValue(path, lines, k, sv)
+			if err != nil {
+				return err
+			}
+			v[k] = s
+		}
+	case []interface{}:
+		for i, sv := range v {
+			s, err := expandEnvValue(path, lines, key, sv)
+			if err != nil {
+				return err
+			}
+			v[i] = s
+		}
+	}
+
+	return nil
+}
+
+// expandEnvValue returns value of key with ${VAR} references expanded.
+func expandEnvValue(path string, lines []string, key string, value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok {
+		return value, expandEnv(path, lines, key, value)
+	}
+
+	var err error
+
+	s = envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRef.FindStringSubmatch(ref)[1]
+
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = &configError{path: path, line: lineOf(lines, key), msg: fmt.Sprintf("environment variable %s is not set", name)}
+		}
+
+		return value
+	})
+
+	return s, err
+}
+
+// findConfig returns the first of names found in dir, or an empty string.
+func findConfig(dir string, names []string) string {
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// xdgConfigDirs returns $XDG_CONFIG_HOME/ghec-backup and
+// ~/.config/ghec-backup, so the config is found when run from cron.
+func xdgConfigDirs() (dirs []string) {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		dirs = append(dirs, filepath.Join(xdg, "ghec-backup"))
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".config", "ghec-backup"))
+	}
+
+	return dirs
+}
+
+// configType returns the viper config type for path based on its extension.
+func configType(path string) string {
+	switch ext := strings.TrimPrefix(filepath.Ext(path), "."); ext {
+	case "json", "toml", "yaml", "yml":
+		return ext
+	}
+
+	return "yml"
+}
+
+// validateConfig checks the config file for unknown keys, wrong types, and
+// mutually exclusive options, which viper would otherwise silently ignore.
+func validateConfig(path string, lines []string, settings map[string]interface{}) error {
+	fail := func(key, format string, a ...interface{}) error {
+		return &configError{path: path, line: lineOf(lines, key), msg: fmt.Sprintf(format, a...)}
+	}
+
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	known := knownKeys()
+
+	var exclusive []string
+
+	for _, key := range keys {
+		value := settings[key]
+
+		want, ok := known[key]
+		if !ok {
+			if flagOnlyKeys[key] {
+				return fail(key, "%q can only be set on the command line", key)
+			}
+
+			if s := suggest(key, known); s != "" {
+				return fail(key, "unknown key %q, did you mean %q?", key, s)
+			}
+			return fail(key, "unknown key %q", key)
+		}
+
+		if !hasType(value, want) {
+			return fail(key, "%q must be a %s, got %T", key, want, value)
+		}
+
+		if key == "token_source" {
+			for sub, sv := range value.(map[string]interface{}) {
+				if !tokenSourceKeys[sub] {
+					return fail(sub, "unknown token_source key %q", sub)
+				}
+
+				if !hasType(sv, "string") {
+					return fail(sub, "token_source %q must be a string, got %T", sub, sv)
+				}
+			}
+		}
+
+		if key == "hooks" {
+			for sub, sv := range value.(map[string]interface{}) {
+				if !hookKeys[sub] {
+					return fail(sub, "unknown hook %q, must be pre, post, or on_failure", sub)
+				}
+
+				if !hasType(sv, "stringSlice") {
+					return fail(sub, "hook %q must be a command or list of commands, got %T", sub, sv)
+				}
+			}
+		}
+
+		if key == "plugins" {
+			for sub, sv := range value.(map[string]interface{}) {
+				if !pluginKeys[sub] {
+					return fail(sub, "unknown plugin type %q, must be storage or notifier", sub)
+				}
+
+				if !hasType(sv, "stringSlice") {
+					return fail(sub, "plugin %q must be a command or list of commands, got %T", sub, sv)
+				}
+			}
+		}
+
+		for _, e := range exclusiveKeys {
+			if key == e {
+				exclusive = append(exclusive, key)
+			}
+		}
+	}
+
+	if len(exclusive) > 1 {
+		return fail(exclusive[1], "%s are mutually exclusive", strings.Join(exclusive, ", "))
+	}
+
+	return nil
+}
+
+// knownKeys maps every valid config key to its expected type.
+func knownKeys() map[string]string {
+	known := map[string]string{}
+
+	pflag.CommandLine.VisitAll(func(f *pflag.Flag) {
+		if !flagOnlyKeys[f.Name] {
+			known[f.Name] = f.Value.Type()
+		}
+	})
+
+	for k, t := range configOnlyKeys {
+		known[k] = t
+	}
+
+	return known
+}
+
+func hasType(value interface{}, want string) bool {
+	// a value that is only a ${VAR} reference gets its type from the environment
+	if s, ok := value.(string); ok && s != "" && want != "map" && envRef.FindString(s) == s {
+		return true
+	}
+
+	switch want {
+	case "bool":
+		_, ok := value.(bool)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "int", "int64", "uint", "uint64":
+		switch value.(type) {
+		case int, int64, float64:
+			return true
+		}
+		return false
+	case "float64":
+		switch value.(type) {
+		case int, int64, float64:
+			return true
+		}
+		return false
+	case "stringSlice":
+		switch vs := value.(type) {
+		case string:
+			return true
+		case []interface{}:
+			for _, v := range vs {
+				if _, ok := v.(string); !ok {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	case "map":
+		_, ok := value.(map[string]interface{})
+		return ok
+	}
+
+	// flag types without a config equivalent (e.g. durations) are parsed by viper
+	return true
+}
+
+// lineOf returns the first line (1-based) defining key, or 0 if not found.
+func lineOf(lines []string, key string) int {
+	re := regexp.MustCompile(`(?i)(^|[\s{,])"?` + regexp.QuoteMeta(key) + `"?\s*[:=]`)
+
+	for i, l := range lines {
+		if re.MatchString(l) {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// suggest returns the known key closest to a misspelled key, if any is close.
+func suggest(key string, known map[string]string) string {
+	best, dist := "", 3
+
+	for k := range known {
+		if d := levenshtein(key, k); d < dist || (d == dist && k < best) {
+			best, dist = k, d
+		}
+	}
+
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
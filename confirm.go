@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// prompting reports whether confirmations are asked, without a terminal or
+// with --yes they are confirmed, so automation is never blocked.
+func prompting() bool {
+	return !assumeYes && interactive && isTerminal(os.Stdin) && !jsonProgress()
+}
+
+// confirm asks question if prompting.
+func confirm(question string) bool {
+	if !prompting() {
+		return true
+	}
+
+	return yes(prompt(bufio.NewReader(os.Stdin), question+" [y/N]", ""))
+}
+
+// confirmLock confirms locking count repositories, which blocks pushes for
+// everyone until the backup is downloaded.
+func confirmLock(count int) bool {
+	return confirm(fmt.Sprintf("Lock %d repositories of %s while backing up?", count, organization))
+}
+
+// confirmDelete confirms downloading and deleting migration id, which can't
+// be downloaded again afterwards.
+func confirmDelete(id int64) bool {
+	return confirm(fmt.Sprintf("Download and delete migration %d of %s?", id, organization))
+}
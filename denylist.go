@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// neverBackup are the repository names or glob patterns of the never_backup
+// config key, excluded from every backup, even with --repository.
+var neverBackup []string
+
+func readNeverBackup() {
+	neverBackup = hookCommands(viper.Get("never_backup"))
+}
+
+// excludeNeverBackup returns the repositories of repos that don't match
+// never_backup, and those that do. Repository names are case-insensitive.
+func excludeNeverBackup(repos []string) (kept, excluded []string) {
+	if len(neverBackup) == 0 {
+		return repos, nil
+	}
+
+	for _, r := range repos {
+		if neverBackupMatch(r) {
+			excluded = append(excluded, r)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+
+	return kept, excluded
+}
+
+func neverBackupMatch(repo string) bool {
+	for _, pattern := range neverBackup {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(repo)); ok {
+			return true
+		}
+	}
+
+	return false
+}
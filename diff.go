@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/stoe/ghec-backup/pkg/backup"
+)
+
+// backupContents maps repository names to their size in bytes, 0 if unknown.
+type backupContents map[string]uint64
+
+// diffBackups reports repositories added and removed, and size changes,
+// between two backups given as summaries (--summary-json) or archives.
+func diffBackups(a, b string) error {
+	if a == "" || b == "" {
+		return errors.New("diff requires two summaries or archives")
+	}
+
+	before, err := loadBackupContents(a)
+	if err != nil {
+		return err
+	}
+
+	after, err := loadBackupContents(b)
+	if err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for n := range before {
+		names[n] = true
+	}
+	for n := range after {
+		names[n] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	var added, removed, changed int
+	var totalBefore, totalAfter uint64
+
+	for _, n := range sorted {
+		sb, inBefore := before[n]
+		sa, inAfter := after[n]
+		totalBefore += sb
+		totalAfter += sa
+
+		switch {
+		case !inBefore:
+			added++
+			fmt.Printf("+ %s%s\n", n, sizeSuffix(sa))
+		case !inAfter:
+			removed++
+			fmt.Printf("- %s%s\n", n, sizeSuffix(sb))
+		case sb != sa && sb > 0 && sa > 0:
+			changed++
+			fmt.Printf("~ %s %s -> %s (%s)\n", n, humanize.Bytes(sb), humanize.Bytes(sa), sizeDelta(sb, sa))
+		}
+	}
+
+	fmt.Printf("\n%d added, %d removed, %d changed", added, removed, changed)
+	if totalBefore > 0 && totalAfter > 0 {
+		fmt.Printf(", total %s -> %s (%s)", humanize.Bytes(totalBefore), humanize.Bytes(totalAfter), sizeDelta(totalBefore, totalAfter))
+	}
+	fmt.Println()
+
+	return nil
+}
+
+// loadBackupContents reads the repositories of a backup from a summary JSON
+// file, using the sizes of its archive if it's still available, or directly
+// from an archive.
+func loadBackupContents(path string) (backupContents, error) {
+	if !strings.HasSuffix(path, ".json") {
+		return backup.ArchiveRepositories(path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s Summary
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if s.Archive != nil {
+		if _, err := os.Stat(s.Archive.Path); err == nil {
+			return backup.ArchiveRepositories(s.Archive.Path)
+		}
+	}
+
+	// failed and missing repositories aren't in the archive
+	contents := backupContents{}
+	for _, r := range s.Repositories {
+		if r.Status == "exported" {
+			contents[r.Name] = r.Bytes
+		}
+	}
+
+	return contents, nil
+}
+
+func sizeSuffix(size uint64) string {
+	if size == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%s)", humanize.Bytes(size))
+}
+
+func sizeDelta(before, after uint64) string {
+	if after >= before {
+		return "+" + humanize.Bytes(after-before)
+	}
+
+	return "-" + humanize.Bytes(before-after)
+}
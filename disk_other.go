@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// freeSpace isn't supported on this platform.
+func freeSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("free space of %s: unsupported on %s", path, runtime.GOOS)
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users at path.
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns the bytes available to the current user at path.
+func freeSpace(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, nil, nil); err != nil {
+		return 0, err
+	}
+
+	return free, nil
+}
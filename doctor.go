@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+const (
+	// minimum free disk space to download an archive into
+	minFreeSpace = 1 << 30
+
+	// maximum tolerated difference between the local and GitHub clocks
+	maxClockSkew = time.Minute
+)
+
+// doctor verifies the environment can run a backup and prints a pass/fail
+// checklist. It returns false if any check failed.
+func doctor() bool {
+	ok := true
+
+	check := func(passed bool, format string, a ...interface{}) {
+		status := colorize(colorGreen, "pass")
+		if !passed {
+			status = colorize(colorRed, "FAIL")
+			ok = false
+		}
+
+		fmt.Printf("[%s] %s\n", status, fmt.Sprintf(format, a...))
+	}
+
+	// token validity and scopes
+	me, resp, err := client.REST.Users.Get(ctx, "")
+	if err != nil {
+		check(false, "token: %s", err)
+		return false
+	}
+
+	scopes := resp.Header.Get("X-OAuth-Scopes")
+	switch {
+	case scopes == "":
+		// fine-grained tokens and GitHub Apps don't report scopes
+		check(true, "token valid for %s (scopes not reported)", me.GetLogin())
+	case hasScopes(scopes, "repo", "admin:org"):
+		check(true, "token valid for %s (scopes: %s)", me.GetLogin(), scopes)
+	default:
+		check(false, "token for %s is missing repo and/or admin:org scopes (scopes: %s)", me.GetLogin(), scopes)
+	}
+
+	// clock skew
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		skew := time.Since(date).Round(time.Second)
+		check(skew < maxClockSkew && skew > -maxClockSkew, "clock skew %s", skew)
+	}
+
+	// organization accessibility
+	if user != "" {
+		if _, _, err := client.REST.Migrations.ListUserMigrations(ctx); err != nil {
+			check(false, "user %s migrations: %s", user, err)
+		} else {
+			check(true, "user %s migrations accessible", user)
+		}
+	} else if _, _, err := client.REST.Organizations.Get(ctx, organization); err != nil {
+		check(false, "organization %s: %s", organization, err)
+	} else if _, _, err := client.REST.Migrations.ListMigrations(ctx, organization, &rest.ListOptions{PerPage: 1}); err != nil {
+		check(false, "organization %s migrations: %s", organization, err)
+	} else {
+		check(true, "organization %s accessible", organization)
+	}
+
+	// rate limit
+	if limits, _, err := client.REST.RateLimits(ctx); err != nil {
+		check(false, "rate limit: %s", err)
+	} else {
+		core := limits.GetCore()
+		check(
+			core.Remaining > 0,
+			"rate limit %d/%d remaining, resets %s",
+			core.Remaining,
+			core.Limit,
+			core.Reset.Format(time.RFC3339),
+		)
+	}
+
+	// storages are reachable, plugins can't be probed
+	for _, st := range storages {
+		p, ok := st.(ProbeStorage)
+		if !ok {
+			continue
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, storageProbeTimeout)
+		if err := p.Probe(probeCtx); err != nil {
+			check(false, "storage %s: %s", st, redact(err.Error()))
+		} else {
+			check(true, "storage %s reachable", st)
+		}
+		cancel()
+	}
+
+	// destination is writable and has enough free space
+	wd, err := filepath.Abs(destination)
+	if err == nil {
+		err = os.MkdirAll(wd, 0755)
+	}
+
+	if err != nil {
+		check(false, "destination: %s", err)
+		return ok
+	}
+
+	if f, err := ioutil.TempFile(wd, ".ghec-backup-doctor"); err != nil {
+		check(false, "destination %s not writable: %s", wd, err)
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+		check(true, "destination %s writable", wd)
+	}
+
+	if free, err := freeSpace(wd); err != nil {
+		check(false, "disk space: %s", err)
+	} else {
+		check(free >= minFreeSpace, "disk space %s free", humanize.Bytes(free))
+	}
+
+	return ok
+}
+
+// hasScopes reports whether the comma separated X-OAuth-Scopes header value
+// contains all of the wanted scopes.
+func hasScopes(header string, wanted ...string) bool {
+	granted := map[string]bool{}
+	for _, s := range strings.Split(header, ",") {
+		granted[strings.TrimSpace(s)] = true
+	}
+
+	for _, w := range wanted {
+		if !granted[w] {
+			return false
+		}
+	}
+
+	return true
+}
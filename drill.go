@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stoe/ghec-backup/pkg/backup"
+
+	graphql "github.com/shurcooL/githubv4"
+)
+
+// drill restores a random repository from the latest (or given) archive into
+// a scratch bare repository and verifies its HEAD against the live repository.
+func drill(archive string) error {
+	if archive == "" {
+		var err error
+		if archive, err = latestArchive(destination, organization); err != nil {
+			return err
+		}
+	}
+
+	sizes, err := backup.ArchiveRepositories(archive)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for n := range sizes {
+		names = append(names, n)
+	}
+
+	if len(names) == 0 {
+		return fmt.Errorf("no repositories found in %s", archive)
+	}
+	sort.Strings(names)
+
+	rand.Seed(time.Now().UnixNano())
+	name := names[rand.Intn(len(names))]
+
+	fmt.Printf("Drill: restoring %s/%s from %s\n", organization, name, archive)
+
+	dir, err := ioutil.TempDir("", "ghec-backup-drill")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := backup.ExtractRepositories(archive, dir, map[string]bool{name: true}); err != nil {
+		return err
+	}
+
+	gitDirs, err := filepath.Glob(filepath.Join(dir, "repositories", "*", name+".git"))
+	if err != nil || len(gitDirs) == 0 {
+		return fmt.Errorf("%s not found in %s", name, archive)
+	}
+
+	// restoring is a clone of the archived git data into a fresh repository
+	scratch := filepath.Join(dir, "restore", name+".git")
+	if out, err := exec.Command("git", "clone", "--quiet", "--bare", gitDirs[0], scratch).CombinedOutput(); err != nil {
+		return fmt.Errorf("git clone: %s", strings.TrimSpace(string(out)))
+	}
+
+	out, err := exec.Command("git", "--git-dir", scratch, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return fmt.Errorf("%s has no HEAD: %s", name, err)
+	}
+	restored := strings.TrimSpace(string(out))
+
+	var q struct {
+		Repository struct {
+			DefaultBranchRef struct {
+				Name   string
+				Target struct {
+					Oid string
+				}
+			}
+		} `graphql:"repository(owner: $owner, name: $name)"`
+	}
+
+	if err := client.GraphQL.Query(ctx, &q, map[string]interface{}{
+		"owner": graphql.String(organization),
+		"name":  graphql.String(name),
+	}); err != nil {
+		return err
+	}
+
+	live := q.Repository.DefaultBranchRef.Target.Oid
+	fmt.Printf("  restored HEAD %s\n  live %s %s\n", restored, q.Repository.DefaultBranchRef.Name, live)
+
+	if restored == live {
+		fmt.Printf("Drill: %s\n", colorize(colorGreen, "pass"))
+		return nil
+	}
+
+	// the live repository may have moved on since the backup was taken
+	cmp, _, err := client.REST.Repositories.CompareCommits(ctx, organization, name, restored, live)
+	if err != nil {
+		return fmt.Errorf("restored HEAD %s not found in live repository: %s", restored, err)
+	}
+
+	if cmp.GetStatus() != "ahead" {
+		return fmt.Errorf("restored HEAD %s is %s of live %s", restored, cmp.GetStatus(), live)
+	}
+
+	fmt.Printf("Drill: %s (live is %d commits ahead of the backup)\n", colorize(colorGreen, "pass"), cmp.GetAheadBy())
+
+	return nil
+}
+
+// latestArchive returns the most recent backup archive of org in dest, in
+// the <dest>/<org>/<date>/ layout or directly in dest.
+func latestArchive(dest, org string) (string, error) {
+	var archives []string
+	for _, pattern := range []string{
+		filepath.Join(dest, org, "*", "backup.*.tar.gz"),
+		filepath.Join(dest, "backup.*.tar.gz"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", err
+		}
+		archives = append(archives, matches...)
+	}
+
+	if len(archives) == 0 {
+		return "", errors.New("no backup archive found")
+	}
+
+	latest, latestMod := "", time.Time{}
+	for _, a := range archives {
+		if fi, err := os.Stat(a); err == nil && fi.ModTime().After(latestMod) {
+			latest, latestMod = a, fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// archivePath returns where the archive of org started at t is written,
+// <dest>/<org>/<date>/backup.<org>.<unix>.tar.gz, so archives of different
+// organizations can't be confused or overwritten.
+func archivePath(dest, org string, t time.Time) string {
+	return filepath.Join(dest, org, t.Format("2006-01-02"), fmt.Sprintf("backup.%s.%d.tar.gz", org, t.Unix()))
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	driveUploadURL = "https://www.googleapis.com/upload/drive/v3/files"
+	driveFilesURL  = "https://www.googleapis.com/drive/v3/files"
+
+	// drive.file only covers files the app created, not a folder shared with
+	// the service account, so the upload needs full access
+	driveScope = "https://www.googleapis.com/auth/drive"
+
+	// driveChunkSize must be a multiple of 256 KiB
+	driveChunkSize = 64 << 20
+
+	// driveRetries is how often a chunk is resumed after a failed request
+	driveRetries = 3
+)
+
+// driveStorage stores archives in a Google Drive folder, including folders of
+// shared drives, with a service account from GOOGLE_APPLICATION_CREDENTIALS.
+// Service accounts have no storage of their own, so the folder must be on a
+// shared drive the account is a member of, or GDRIVE_SUBJECT must name the
+// Workspace user to act as via domain-wide delegation.
+type driveStorage struct {
+	folder string
+
+	// serve probes the storage while a job uploads to it
+	mu     sync.Mutex
+	client *http.Client
+}
+
+func (d *driveStorage) String() string {
+	return "gdrive:" + d.folder
+}
+
+// serviceAccount is the subset of a Google service account key we use.
+type serviceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// httpClient authenticates requests as the service account, created on first
+// use so downloadClient's proxy and TLS settings apply.
+func (d *driveStorage) httpClient() (*http.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	keyFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if keyFile == "" {
+		return nil, errors.New("gdrive storage requires GOOGLE_APPLICATION_CREDENTIALS")
+	}
+
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var key serviceAccount
+	if err := json.Unmarshal(b, &key); err != nil || key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("%s is not a service account key", keyFile)
+	}
+
+	cfg := &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyID,
+		Subject:      os.Getenv("GDRIVE_SUBJECT"),
+		Scopes:       []string{driveScope},
+		TokenURL:     key.TokenURI,
+	}
+	if cfg.TokenURL == "" {
+		cfg.TokenURL = "https://oauth2.googleapis.com/token"
+	}
+
+	d.client = cfg.Client(context.WithValue(context.Background(), oauth2.HTTPClient, downloadClient))
+
+	return d.client, nil
+}
+
+// Upload implements Storage. The archive is uploaded in chunks with a
+// resumable upload session, a chunk that fails is resumed from the last byte
+// Drive received. The stored size and SHA-256 checksum are verified.
+func (d *driveStorage) Upload(ctx context.Context, file, name, checksum string) error {
+	client, err := d.httpClient()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	session, err := d.startSession(ctx, client, path.Base(name), size, checksum)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	var result *http.Response
+
+	progress := newUploadProgress(d, size)
+	defer progress.finish()
+
+	for retries := 0; result == nil; {
+		end := offset + driveChunkSize
+		if end > size {
+			end = size
+		}
+
+		verbosef("%s: uploading bytes %d-%d of %s", d, offset, end, name)
+
+		resp, err := d.put(ctx, client, session, io.NewSectionReader(f, offset, end-offset), offset, end, size)
+		if err == nil && resp.StatusCode >= 500 {
+			resp.Body.Close()
+			err = fmt.Errorf("%s", resp.Status)
+		}
+
+		if err != nil {
+			if retries++; retries > driveRetries || ctx.Err() != nil {
+				return fmt.Errorf("%s: uploading %s: %s", d, name, err)
+			}
+
+			verbosef("%s: resuming %s after %s", d, name, err)
+
+			// ask how much was received, and continue from there
+			if resp, err = d.put(ctx, client, session, nil, 0, 0, size); err != nil {
+				continue
+			}
+			if resp.StatusCode >= 500 {
+				resp.Body.Close()
+				continue
+			}
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			result = resp
+			progress.update(uint64(size), uint64(size))
+		case 308: // Resume Incomplete
+			resp.Body.Close()
+			previous := offset
+			offset = 0
+			if r := resp.Header.Get("Range"); r != "" {
+				last, err := strconv.ParseInt(r[strings.LastIndex(r, "-")+1:], 10, 64)
+				if err != nil {
+					return fmt.Errorf("%s: invalid range %q", d, r)
+				}
+				offset = last + 1
+			}
+			progress.update(uint64(offset), uint64(size))
+
+			// only failures without progress in between count towards the retries
+			if offset > previous {
+				retries = 0
+			}
+		default:
+			resp.Body.Close()
+			return fmt.Errorf("%s: uploading %s: %s", d, name, resp.Status)
+		}
+	}
+	defer result.Body.Close()
+
+	var stored struct {
+		ID             string `json:"id"`
+		Size           string `json:"size"`
+		SHA256Checksum string `json:"sha256Checksum"`
+	}
+	if err := json.NewDecoder(result.Body).Decode(&stored); err != nil {
+		return err
+	}
+
+	if stored.Size != strconv.FormatInt(size, 10) {
+		return fmt.Errorf("%s: stored %s has %s bytes, expected %d", d, name, stored.Size, size)
+	}
+
+	verbosef("%s: stored %s as file %s", d, name, stored.ID)
+
+	// Drive computes the checksum of new files asynchronously
+	if stored.SHA256Checksum == "" {
+		if stored.SHA256Checksum, err = d.checksum(ctx, client, stored.ID); err != nil {
+			return err
+		}
+	}
+
+	return compareChecksum(d, name, checksum, stored.SHA256Checksum)
+}
+
+// checksum returns the SHA-256 checksum Drive computed of file id, or of its
+// content if Drive has none.
+func (d *driveStorage) checksum(ctx context.Context, client *http.Client, id string) (string, error) {
+	get := func(query string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, driveFilesURL+"/"+id+"?supportsAllDrives=true&"+query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: reading file %s: %s", d, id, resp.Status)
+		}
+
+		return resp, nil
+	}
+
+	resp, err := get("fields=sha256Checksum")
+	if err != nil {
+		return "", err
+	}
+
+	var file struct {
+		SHA256Checksum string `json:"sha256Checksum"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&file)
+	resp.Body.Close()
+
+	if err != nil || file.SHA256Checksum != "" {
+		return file.SHA256Checksum, err
+	}
+
+	verbosef("%s: no checksum for file %s yet, downloading it", d, id)
+
+	if resp, err = get("alt=media"); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return hashChecksum(resp.Body)
+}
+
+// Probe implements ProbeStorage by reading the folder.
+func (d *driveStorage) Probe(ctx context.Context) error {
+	client, err := d.httpClient()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, driveFilesURL+"/"+d.folder+"?supportsAllDrives=true&fields=id", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%s: %s", d, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: reading folder: %s", d, resp.Status)
+	}
+
+	return nil
+}
+
+// startSession starts a resumable upload of a file to the folder and returns
+// the session URL.
+func (d *driveStorage) startSession(ctx context.Context, client *http.Client, name string, size int64, checksum string) (string, error) {
+	metadata, err := json.Marshal(map[string]interface{}{
+		"name":          name,
+		"parents":       []string{d.folder},
+		"appProperties": map[string]string{"sha256": checksum, "organization": organization},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, driveUploadURL+"?uploadType=resumable&supportsAllDrives=true&fields=id,size,sha256Checksum", bytes.NewReader(metadata))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/gzip")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s: starting upload: %s %s", d, resp.Status, bytes.TrimSpace(body))
+	}
+
+	return resp.Header.Get("Location"), nil
+}
+
+// put uploads the bytes start to end of the file, or without body asks for
+// the status of the upload.
+func (d *driveStorage) put(ctx context.Context, client *http.Client, session string, body io.Reader, start, end, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPut, session, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if body == nil {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	} else {
+		req.ContentLength = end - start
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+
+	return client.Do(req)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+// gistsPath returns the path of the gists archive next to the migration
+// archive, gists.<org>.<timestamp>.tar.gz.
+func gistsPath(archive string) string {
+	return filepath.Join(filepath.Dir(archive), "gists."+strings.TrimPrefix(filepath.Base(archive), "backup."))
+}
+
+// archiveGists backs up the gists next to the migration archive and uploads
+// them to the storages.
+func archiveGists(ctx context.Context, archive string) error {
+	path := gistsPath(archive)
+
+	count, warnings, err := backupGists(ctx, path)
+	if err != nil {
+		return fmt.Errorf("gists: %w", err)
+	}
+
+	for _, w := range warnings {
+		printf("%s\n", colorize(colorRed, "Warning: "+w))
+	}
+	summary.Warnings = append(summary.Warnings, warnings...)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	summary.Gists = archiveSummary(path, uint64(info.Size()))
+
+	printf("Backed up %d gists to %s (%s)\n", count, path, humanize.Bytes(uint64(info.Size())))
+	emit(eventGistsArchived, map[string]interface{}{"file": path, "bytes": info.Size(), "gists": count})
+
+	warnings, err = upload(ctx, path)
+	summary.Warnings = append(summary.Warnings, warnings...)
+
+	return err
+}
+
+// backupGists mirrors the gists of the organization members, or of --user,
+// which migrations don't include, into a tar.gz archive at path with one bare
+// repository per gist, <owner>/<id>.git. Gists that fail to clone are
+// returned as warnings.
+func backupGists(ctx context.Context, path string) (count int, warnings []string, err error) {
+	owners := []string{user}
+	if user == "" {
+		if owners, err = organizationMembers(ctx); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ghec-backup-gists")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, owner := range owners {
+		gists, err := listGists(ctx, owner)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		for _, g := range gists {
+			target := filepath.Join(dir, owner, g.GetID()+".git")
+
+			verbosef("gist %s/%s: cloning %s", owner, g.GetID(), g.GetGitPullURL())
+
+			cmd := exec.CommandContext(ctx, "git", "clone", "--quiet", "--mirror", g.GetGitPullURL(), target)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				warnings = append(warnings, fmt.Sprintf("gist %s/%s: %s: %s", owner, g.GetID(), err, strings.TrimSpace(string(out))))
+				continue
+			}
+
+			count++
+		}
+	}
+
+	if err := writeTarGz(dir, path); err != nil {
+		return 0, nil, err
+	}
+
+	return count, warnings, nil
+}
+
+// organizationMembers returns the logins of all organization members.
+func organizationMembers(ctx context.Context) ([]string, error) {
+	var logins []string
+
+	opts := &rest.ListMembersOptions{ListOptions: rest.ListOptions{PerPage: 100}}
+	for {
+		members, resp, err := client.REST.Organizations.ListMembers(ctx, organization, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range members {
+			logins = append(logins, m.GetLogin())
+		}
+
+		if resp.NextPage == 0 {
+			return logins, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// listGists returns the gists of owner, including secret gists for --user.
+func listGists(ctx context.Context, owner string) ([]*rest.Gist, error) {
+	// the authenticated user's own list includes their secret gists
+	login := owner
+	if user != "" {
+		login = ""
+	}
+
+	var gists []*rest.Gist
+
+	opts := &rest.GistListOptions{ListOptions: rest.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := client.REST.Gists.List(ctx, login, opts)
+		if err != nil {
+			return nil, err
+		}
+		gists = append(gists, page...)
+
+		if resp.NextPage == 0 {
+			return gists, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// writeTarGz writes the files in dir into a gzipped tarball at path, with
+// paths relative to dir.
+func writeTarGz(dir, path string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
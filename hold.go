@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// hold sets or releases the legal hold on the backup id in the catalog and
+// in the storages it was uploaded to that support holds, action is set or
+// release.
+func hold(action, id string) error {
+	if action != "set" && action != "release" {
+		return fmt.Errorf("unknown hold action %q, supported: set, release", action)
+	}
+
+	if id == "" {
+		return fmt.Errorf("hold %s requires a backup id, see catalog export", action)
+	}
+
+	entries, err := readCatalogEntries(destination)
+	if err != nil {
+		return err
+	}
+
+	var e *catalogEntry
+	for i := range entries {
+		if entries[i].id() == id {
+			e = &entries[i]
+		}
+	}
+
+	if e == nil {
+		return fmt.Errorf("no backup %s in %s", id, catalogPath(destination))
+	}
+
+	set := action == "set"
+
+	stored := map[string]bool{}
+	for _, l := range e.Locations {
+		stored[l] = true
+	}
+
+	// hold the stored copies first, so a failure leaves the catalog unchanged
+	for _, s := range storages {
+		if !stored[fmt.Sprint(s)] {
+			continue
+		}
+
+		h, ok := s.(HoldStorage)
+		if !ok {
+			printf("%s\n", colorize(colorRed, fmt.Sprintf("Warning: %s doesn't support holds, %s its retention there manually", s, action)))
+			continue
+		}
+
+		if err := h.Hold(ctx, e.SHA256, set); err != nil {
+			return err
+		}
+	}
+
+	// runs may have been recorded meanwhile, re-read the catalog under its lock
+	err = updateCatalog(destination, func(entries []catalogEntry) error {
+		for i := range entries {
+			if entries[i].id() != id {
+				continue
+			}
+
+			if set && entries[i].HeldSince == nil {
+				now := time.Now().UTC()
+				entries[i].HeldSince = &now
+			} else if !set {
+				entries[i].HeldSince = nil
+			}
+			return nil
+		}
+
+		return fmt.Errorf("no backup %s in %s", id, catalogPath(destination))
+	})
+	if err != nil {
+		return err
+	}
+
+	if set {
+		audit(auditHoldSet, e.Organization, map[string]interface{}{"backup": id, "file": e.Archive})
+		printf("Set legal hold on backup %s\n", id)
+	} else {
+		audit(auditHoldReleased, e.Organization, map[string]interface{}{"backup": id, "file": e.Archive})
+		printf("Released legal hold on backup %s\n", id)
+	}
+
+	return nil
+}
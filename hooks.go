@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Hooks are external commands run before the backup, after it succeeded, and
+// after it failed, configured in the hooks config block.
+type Hooks struct {
+	Pre       []string
+	Post      []string
+	OnFailure []string
+}
+
+var (
+	hooks Hooks
+
+	hookKeys = map[string]bool{
+		"pre":        true,
+		"post":       true,
+		"on_failure": true,
+	}
+)
+
+// readHooks reads the hooks config block, each hook is a command or a list of
+// commands.
+func readHooks() {
+	hooks = Hooks{
+		Pre:       hookCommands(viper.Get("hooks.pre")),
+		Post:      hookCommands(viper.Get("hooks.post")),
+		OnFailure: hookCommands(viper.Get("hooks.on_failure")),
+	}
+}
+
+func hookCommands(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		commands := make([]string, 0, len(v))
+		for _, c := range v {
+			commands = append(commands, fmt.Sprint(c))
+		}
+		return commands
+	}
+
+	return nil
+}
+
+// runHooks runs the commands of hook in a shell with the run metadata exposed
+// as GHEC_BACKUP_* environment variables. Their output goes to stderr, so it
+// doesn't mix with JSON progress.
+func runHooks(hook string, commands []string, s *Summary) error {
+	for _, c := range commands {
+		verbosef("running %s hook: %s", hook, c)
+
+		cmd := shellCommand(ctx, c)
+		cmd.Env = append(os.Environ(), hookEnv(hook, s)...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %q: %s", hook, c, err)
+		}
+	}
+
+	return nil
+}
+
+// shellCommand runs command in the platform's shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// hookEnv returns the run metadata of s as environment variables.
+func hookEnv(hook string, s *Summary) []string {
+	repositories := make([]string, len(s.Repositories))
+	for i, r := range s.Repositories {
+		repositories[i] = r.Name
+	}
+
+	env := []string{
+		"GHEC_BACKUP_HOOK=" + hook,
+		"GHEC_BACKUP_ORGANIZATION=" + s.Organization,
+		"GHEC_BACKUP_STATUS=" + s.Status,
+		"GHEC_BACKUP_REPOSITORIES=" + strings.Join(repositories, ","),
+		"GHEC_BACKUP_ERROR=" + strings.Join(s.Errors, "; "),
+		"GHEC_BACKUP_SUMMARY_JSON=" + summaryJSON,
+	}
+
+	if s.MigrationID != 0 {
+		env = append(env, "GHEC_BACKUP_MIGRATION_ID="+strconv.FormatInt(s.MigrationID, 10))
+	}
+
+	if s.Archive != nil {
+		env = append(env,
+			"GHEC_BACKUP_ARCHIVE="+s.Archive.Path,
+			"GHEC_BACKUP_BYTES="+strconv.FormatUint(s.Archive.Bytes, 10),
+		)
+	}
+
+	if !s.FinishedAt.IsZero() {
+		env = append(env, "GHEC_BACKUP_DURATION_SECONDS="+strconv.Itoa(int(s.DurationSeconds)))
+	}
+
+	return env
+}
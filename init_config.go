@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// initConfig interactively scaffolds a commented .ghec-backup.yml.
+func initConfig() error {
+	path := ".ghec-backup.yml"
+	if cfg != "" {
+		if fi, err := os.Stat(cfg); err == nil && fi.IsDir() {
+			path = filepath.Join(cfg, path)
+		} else {
+			path = cfg
+		}
+	}
+	dir := filepath.Dir(path)
+
+	in := bufio.NewReader(os.Stdin)
+
+	if _, err := os.Stat(path); err == nil {
+		if !yes(prompt(in, fmt.Sprintf("%s exists, overwrite? [y/N]", path), "")) {
+			return errors.New("aborted")
+		}
+	}
+
+	org := prompt(in, "Organization", organization)
+	if org == "" {
+		return errors.New("organization is required")
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# ghec-backup configuration, see `ghec-backup --help` for all options\n\n")
+	fmt.Fprintf(&b, "# organization to backup\norganization: %s\n\n", org)
+
+	fmt.Fprintf(&b, "# token source, the token needs the repo and admin:org scopes\n")
+	switch source := prompt(in, "Token source [gh, file, env, vault, aws, gcp]", "gh"); source {
+	case "gh":
+		fmt.Fprintf(&b, "auth: gh\n\n")
+	case "file":
+		fmt.Fprintf(&b, "token-file: %s\n\n", prompt(in, "Token file", "/run/secrets/gh_token"))
+	case "env":
+		fmt.Fprintf(&b, "token: ${%s}\n\n", prompt(in, "Environment variable", "GITHUB_TOKEN"))
+	case "vault":
+		fmt.Fprintf(&b, "token_source:\n  type: vault\n")
+		fmt.Fprintf(&b, "  address: %s # default: VAULT_ADDR\n", prompt(in, "Vault address", os.Getenv("VAULT_ADDR")))
+		fmt.Fprintf(&b, "  path: %s\n", prompt(in, "Vault secret path", "secret/data/ghec-backup"))
+		fmt.Fprintf(&b, "  field: token\n\n")
+	case "aws":
+		fmt.Fprintf(&b, "token_source:\n  type: aws\n")
+		fmt.Fprintf(&b, "  secret_id: %s\n", prompt(in, "Secret ID", "ghec-backup"))
+		fmt.Fprintf(&b, "  region: %s\n\n", prompt(in, "Region", os.Getenv("AWS_REGION")))
+	case "gcp":
+		fmt.Fprintf(&b, "token_source:\n  type: gcp\n")
+		fmt.Fprintf(&b, "  secret_id: %s\n", prompt(in, "Secret", "ghec-backup"))
+		fmt.Fprintf(&b, "  project: %s\n\n", prompt(in, "Project", ""))
+	default:
+		return fmt.Errorf("unsupported token source %q", source)
+	}
+
+	fmt.Fprintf(&b, "# repositories to backup, default: all organization repositories\n")
+	if r := prompt(in, "Repositories (comma separated, empty for all)", ""); r != "" {
+		fmt.Fprintf(&b, "repository:\n")
+		for _, name := range strings.Split(r, ",") {
+			fmt.Fprintf(&b, "  - %s\n", strings.TrimSpace(name))
+		}
+	} else {
+		fmt.Fprintf(&b, "# repository:\n#   - my-repo\n")
+	}
+	fmt.Fprintf(&b, "\n")
+
+	// absolute, so archives don't end up in the working directory of cron
+	abs, _ := filepath.Abs(dir)
+	fmt.Fprintf(&b, "# directory to write archives to\ndestination: %s\n\n", prompt(in, "Destination", abs))
+
+	fmt.Fprintf(&b, "# lock repositories while backing up\nlock: %t\n", yes(prompt(in, "Lock repositories while backing up? [y/N]", "")))
+
+	schedule := prompt(in, "Schedule (cron expression, empty to skip)", "0 2 * * *")
+
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nWrote %s\n", path)
+
+	if schedule != "" {
+		// cron runs with a minimal environment, point to the config explicitly
+		cfgPath, _ := filepath.Abs(path)
+		fmt.Printf("\nAdd this line to your crontab (crontab -e) to schedule backups:\n  %s ghec-backup --config %s\n", schedule, cfgPath)
+	}
+
+	return nil
+}
+
+// prompt asks for a value on stdin, returning def if the answer is empty.
+func prompt(in *bufio.Reader, label, def string) string {
+	if def != "" {
+		fmt.Printf("%s (%s): ", label, def)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+
+	answer, _ := in.ReadString('\n')
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def
+	}
+
+	return answer
+}
+
+func yes(answer string) bool {
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+// statsRetries is how often contributor statistics are requested again while
+// GitHub computes them, statsInterval apart.
+const (
+	statsRetries  = 5
+	statsInterval = 3 * time.Second
+)
+
+// insights is a snapshot of repository traffic and contributor statistics.
+// GitHub keeps traffic for 14 days only, so it's lost unless captured.
+type insights struct {
+	Organization string                         `json:"organization"`
+	CapturedAt   time.Time                      `json:"captured_at"`
+	Repositories map[string]*repositoryInsights `json:"repositories"`
+}
+
+// repositoryInsights are the insights of a repository, nil sections couldn't
+// be read.
+type repositoryInsights struct {
+	Views        *rest.TrafficViews      `json:"views,omitempty"`
+	Clones       *rest.TrafficClones     `json:"clones,omitempty"`
+	Referrers    []*rest.TrafficReferrer `json:"referrers,omitempty"`
+	Paths        []*rest.TrafficPath     `json:"paths,omitempty"`
+	Contributors []contributorStats      `json:"contributors,omitempty"`
+}
+
+// contributorStats are the weekly commits, additions, and deletions of a
+// contributor.
+type contributorStats struct {
+	Login string              `json:"login"`
+	Total int                 `json:"total"`
+	Weeks []*rest.WeeklyStats `json:"weeks"`
+}
+
+// insightsPath returns the path of the insights snapshot next to the
+// migration archive, insights.<org>.<timestamp>.json.
+func insightsPath(archive string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(archive), "backup."), ".tar.gz")
+	return filepath.Join(filepath.Dir(archive), "insights."+name+".json")
+}
+
+// captureInsights captures the traffic and contributor statistics of repos
+// next to the migration archive and uploads them to the storages. Insights
+// that can't be read are recorded as warnings.
+func captureInsights(ctx context.Context, archive string, repos []string) error {
+	path := insightsPath(archive)
+
+	in := &insights{
+		Organization: organization,
+		CapturedAt:   time.Now().UTC(),
+		Repositories: map[string]*repositoryInsights{},
+	}
+
+	var warnings []string
+	warn := func(repo, what string, err error) {
+		warnings = append(warnings, fmt.Sprintf("insights %s/%s: %s: %s", organization, repo, what, err))
+	}
+
+	daily := &rest.TrafficBreakdownOptions{Per: "day"}
+
+	for _, repo := range repos {
+		ri := &repositoryInsights{}
+		in.Repositories[repo] = ri
+
+		verbosef("insights %s/%s", organization, repo)
+
+		var err error
+		if ri.Views, _, err = client.REST.Repositories.ListTrafficViews(ctx, organization, repo, daily); err != nil {
+			warn(repo, "views", err)
+		}
+
+		if ri.Clones, _, err = client.REST.Repositories.ListTrafficClones(ctx, organization, repo, daily); err != nil {
+			warn(repo, "clones", err)
+		}
+
+		if ri.Referrers, _, err = client.REST.Repositories.ListTrafficReferrers(ctx, organization, repo); err != nil {
+			warn(repo, "referrers", err)
+		}
+
+		if ri.Paths, _, err = client.REST.Repositories.ListTrafficPaths(ctx, organization, repo); err != nil {
+			warn(repo, "paths", err)
+		}
+
+		if ri.Contributors, err = listContributorStats(ctx, repo); err != nil {
+			warn(repo, "contributors", err)
+		}
+	}
+
+	b, err := json.MarshalIndent(in, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	for _, w := range warnings {
+		printf("%s\n", colorize(colorRed, "Warning: "+w))
+	}
+	summary.Warnings = append(summary.Warnings, warnings...)
+	summary.Insights = archiveSummary(path, uint64(len(b)+1))
+
+	printf("Captured insights of %d repositories to %s (%s)\n", len(repos), path, humanize.Bytes(uint64(len(b)+1)))
+	emit(eventInsightsExported, map[string]interface{}{"file": path, "repositories": len(repos)})
+
+	warnings, err = upload(ctx, path)
+	summary.Warnings = append(summary.Warnings, warnings...)
+
+	return err
+}
+
+// listContributorStats returns the contributor statistics of repo. GitHub
+// computes them in the background and responds 202 Accepted until they are
+// ready, so they are requested again a few times.
+func listContributorStats(ctx context.Context, repo string) ([]contributorStats, error) {
+	for i := 0; ; i++ {
+		stats, _, err := client.REST.Repositories.ListContributorsStats(ctx, organization, repo)
+		if _, ok := err.(*rest.AcceptedError); ok && i < statsRetries {
+			verbosef("insights %s/%s: contributor statistics are being computed, retrying in %s", organization, repo, statsInterval)
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(statsInterval):
+			}
+			continue
+		}
+		if err != nil {
+			if _, ok := err.(*rest.AcceptedError); ok {
+				return nil, fmt.Errorf("statistics not computed after %s", statsInterval*statsRetries)
+			}
+			return nil, err
+		}
+
+		contributors := make([]contributorStats, 0, len(stats))
+		for _, s := range stats {
+			contributors = append(contributors, contributorStats{
+				Login: s.GetAuthor().GetLogin(),
+				Total: s.GetTotal(),
+				Weeks: s.Weeks,
+			})
+		}
+
+		return contributors, nil
+	}
+}
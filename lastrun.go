@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// lastRunPath is the state file with the summary of the last backup of org,
+// read by --retry-failed.
+func lastRunPath(dest, org string) string {
+	return filepath.Join(dest, org, ".last-run.json")
+}
+
+func saveLastRun(dest string, s *Summary) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dest, s.Organization), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(lastRunPath(dest, s.Organization), append(b, '\n'), 0644)
+}
+
+// failedRepositories returns the repositories that failed or were missing
+// from the archive in the last backup of org.
+func failedRepositories(dest, org string) ([]string, error) {
+	b, err := ioutil.ReadFile(lastRunPath(dest, org))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no previous backup of %s to retry", org)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var s Summary
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %s", lastRunPath(dest, org), err)
+	}
+
+	var failed []string
+	for _, r := range s.Repositories {
+		if r.Status == "failed" || r.Status == "missing" {
+			failed = append(failed, r.Name)
+		}
+	}
+
+	return failed, nil
+}
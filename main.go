@@ -2,287 +2,922 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/stoe/ghec-backup/pkg/backup"
+	"golang.org/x/net/http/httpproxy"
 	"golang.org/x/oauth2"
-
-	rest "github.com/google/go-github/v31/github"
-	graphql "github.com/shurcooL/githubv4"
 )
 
 var (
+	// build metadata, injected via -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+
 	// options
-	token        string
-	organization string
-	repos        []string
-	lock         bool
-	help         bool
-	cfg          string
+	token           string
+	tokenFile       string
+	tokenStdin      bool
+	auth            string
+	tokenSource     *TokenSource
+	baseURL         string
+	uploadURL       string
+	graphqlURL      string
+	proxy           string
+	caCert          string
+	clientCert      string
+	clientKey       string
+	debugHTTP       bool
+	organization    string
+	user            string
+	includeGists    bool
+	exportMeta      bool
+	exportSBOM      bool
+	exportInsights  bool
+	destination     string
+	repos           []string
+	labels          []string
+	lock            bool
+	quiet           bool
+	verbose         bool
+	noColor         bool
+	progressFormat  string
+	format          string
+	signingKey      string
+	policyInterval  time.Duration
+	policyRetention time.Duration
+	summaryJSON     string
+	reportPath      string
+	verify          string
+	timeout         time.Duration
+	oncePer         string
+	window          string
+	runWindow       *backup.Window
+	listen          string
+	pickRepos       bool
+	assumeYes       bool
+	migrationID     int64
+	stuckAfter      time.Duration
+	attempts        int
+	failedRetries   int
+	retryFailed     bool
+	rateLimitWarn   float64
+	repoFilter      backup.RepositoryFilter
+	repoCacheTTL    time.Duration
+	maxLock         time.Duration
+	unlockAll       bool
+	forceUnlock     bool
+	includeEmpty    bool
+	retryID         int64
+	auditLog        string
+	textfilePath    string
+	statsdAddress   string
+	uploadQuorum    int
+	storageURLs     []string
+	sentryDSN       string
+	serveToken      string
+	webhookSecret   string
+	help            bool
+	showVersion     bool
+	cfg             string
+	command         string
+
+	// commands that run instead of the backup
+	commands = []struct{ name, usage string }{
+		{"doctor", "Verify token, organization access, rate limit, storages, and disk space."},
+		{"init", "Interactively create a .ghec-backup.yml config file."},
+		{"completion", "Print a completion script for bash, zsh, fish, or powershell."},
+		{"self-update", "Update ghec-backup to the latest release."},
+		{"diff", "Compare two backups (summary JSON or archive): diff <a> <b>"},
+		{"tui", "Run the backup with a live dashboard of migration state, throughput, and recent backups."},
+		{"watch", "Poll a migration and render its state until it completes: watch --migration-id N"},
+		{"unlock", "Unlock repositories left locked by a migration: unlock --migration-id N | --all"},
+		{"retry", "Download the archive of a migration kept after a failed download: retry [--migration-id N]"},
+		{"serve", "Run backups on demand via HTTP API and GitHub webhooks: serve [--listen :8080]"},
+		{"drill", "Restore a random repository from the latest archive and verify it: drill [archive]"},
+		{"catalog", "List all backups in the catalog with location and checksum, or those containing a repository: catalog export | find --repo <name> [--format csv]"},
+		{"hold", "Exempt a backup from pruning, also in storages that support it, or release it: hold set | release <id>"},
+		{"report", "Chart archive size, duration, and repository count of past backups from the catalog, or attest them against a policy in a signed report: report trend [--format csv] | attestation --signing-key <pem>"},
+	}
 
-	// -----
+	// commands that don't need a config or token
+	offlineCommands = map[string]bool{
+		"init":        true,
+		"completion":  true,
+		"self-update": true,
+		"diff":        true,
+	}
 
-	ctx           = context.Background()
-	httpClient    *http.Client
-	restClient    *rest.Client
-	graphqlClient *graphql.Client
+	// commands that read the config but only local files, no token needed
+	localCommands = map[string]bool{
+		"catalog": true,
+		"report":  true,
+	}
 
 	// -----
 
-	query struct {
-		Organization struct {
-			Repositories struct {
-				PageInfo struct {
-					EndCursor   graphql.String
-					HasNextPage bool
-				}
-				Nodes []Repository
-			} `graphql:"repositories(first: 100, after: $page)"`
-		} `graphql:"organization(login: $login)"`
-	}
+	ctx            = context.Background()
+	interactive    = isTerminal(os.Stdout)
+	colorOutput    bool
+	transport      *http.Transport
+	httpClient     *http.Client
+	downloadClient *http.Client
+	client         *backup.Client
 )
 
-// Repository unexported
-type Repository struct {
-	Name string
-}
-
 func init() {
 	// flags
 	pflag.BoolVarP(&help, "help", "h", false, "Print this help.")
-	pflag.StringVarP(&cfg, "config", "c", "", "Path to config file. Default: .ghec-backup in current directory")
-	pflag.StringVarP(&organization, "organization", "o", "", "Organization on github.com to backup.")
-	pflag.StringSliceVarP(&repos, "repository", "r", make([]string, 0), "Repository to backup, can be provided multiple times. Default: organization repositories")
+	pflag.BoolVarP(&showVersion, "version", "v", false, "Print version and build information.")
+	pflag.StringVarP(&cfg, "config", "c", "", "Path to config file, or directory containing .ghec-backup. Default: current directory, then $XDG_CONFIG_HOME/ghec-backup/config.yml, ~/.config/ghec-backup/config.yml")
+	pflag.StringVar(&tokenFile, "token-file", "", "Read the token from a file (e.g. /run/secrets/gh_token).")
+	pflag.BoolVar(&tokenStdin, "token-stdin", false, "Read the token from standard input.")
+	pflag.StringVar(&auth, "auth", "", "Reuse existing credentials, supported: gh (GitHub CLI).")
+	pflag.StringVar(&baseURL, "base-url", "", "GitHub Enterprise Server or GHE.com API URL (e.g. https://ghes.example.com/api/v3). Default: github.com")
+	pflag.StringVar(&uploadURL, "upload-url", "", "Upload URL. Default: derived from --base-url")
+	pflag.StringVar(&graphqlURL, "graphql-url", "", "GraphQL API URL. Default: derived from --base-url")
+	pflag.StringVar(&proxy, "proxy", "", "HTTP(S) proxy URL for all requests. Default: HTTPS_PROXY, HTTP_PROXY")
+	pflag.StringVar(&caCert, "ca-cert", "", "Path to a PEM CA bundle to trust in addition to the system roots.")
+	pflag.StringVar(&clientCert, "client-cert", "", "Path to a PEM client certificate for mTLS.")
+	pflag.StringVar(&clientKey, "client-key", "", "Path to the PEM private key for --client-cert.")
+	pflag.BoolVar(&debugHTTP, "debug-http", false, "Log method, URL, status, and rate limit for every request to stderr.")
+	pflag.StringVarP(&organization, "organization", "o", "", "Organization to backup.")
+	pflag.StringVar(&user, "user", "", "Backup the repositories of this personal account, the authenticated user, instead of an organization.")
+	pflag.StringVarP(&destination, "destination", "d", ".", "Directory to write archives to, as <destination>/<organization>/<date>/backup.<organization>.<timestamp>.tar.gz.")
+	pflag.StringSliceVarP(&repos, "repository", "r", make([]string, 0), "Repository to backup, or to find with catalog find, can be provided multiple times, alias: --repo. Default: organization repositories")
+	pflag.StringSliceVar(&labels, "label", make([]string, 0), "Label the backup in the catalog and restic snapshots (e.g. quarterly), can be provided multiple times. With report and catalog, only use the backups with all of these labels.")
+	pflag.BoolVar(&includeGists, "gists", false, "Also backup the gists of the organization members, or of --user, which migrations don't include.")
+	pflag.BoolVar(&exportMeta, "metadata", false, "Also export repository settings migrations don't include (e.g. merge settings, topics, Pages, deploy keys, collaborators) to metadata.<organization>.<timestamp>.json.")
+	pflag.BoolVar(&exportSBOM, "sbom", false, "Also export the SPDX SBOM of the dependency graph of each repository to sbom.<organization>.<timestamp>.tar.gz.")
+	pflag.BoolVar(&exportInsights, "insights", false, "Also capture repository traffic, which GitHub keeps for 14 days only, and contributor statistics to insights.<organization>.<timestamp>.json.")
+	pflag.BoolVar(&repoFilter.ExcludeArchived, "exclude-archived", false, "Don't backup archived repositories, unless provided with --repository.")
+	pflag.BoolVar(&repoFilter.ExcludeForks, "exclude-forks", false, "Don't backup forks, unless provided with --repository.")
+	pflag.StringVar(&repoFilter.Visibility, "visibility", "", "Only backup repositories with this visibility, unless provided with --repository: public, private, or internal. Default: all")
+	pflag.DurationVar(&repoCacheTTL, "repository-cache-ttl", 0, "Reuse the repository listing of a previous run for this long (e.g. 1h), unless the number of repositories changed. Default: list them every run")
+	pflag.BoolVar(&includeEmpty, "include-empty", false, "Also backup repositories without commits, which are skipped by default.")
+	pflag.BoolVar(&retryFailed, "retry-failed", false, "Only backup the repositories that failed or were missing from the archive in the last backup.")
+	pflag.BoolVar(&pickRepos, "interactive", false, "Pick the repositories to backup from a searchable list.")
 	pflag.BoolVarP(&lock, "lock", "l", false, "Lock repositories while backing up. Default: false")
+	pflag.BoolVarP(&assumeYes, "yes", "y", false, "Don't ask for confirmation before locking repositories, deleting a migration with retry, or unlock --all, alias: --force.")
+	pflag.BoolVarP(&quiet, "quiet", "q", false, "Only print a single-line summary and errors.")
+	pflag.StringVar(&progressFormat, "progress-format", "text", "Progress output format: text, or json for one JSON event per line.")
+	pflag.StringVar(&format, "format", "text", "Output format of the report and catalog commands: text, or csv.")
+	pflag.StringVar(&signingKey, "signing-key", "", "Path to the PEM Ed25519 private key report attestation signs with (e.g. created with openssl genpkey -algorithm ed25519).")
+	pflag.DurationVar(&policyInterval, "policy-interval", 24*time.Hour, "Longest time between successful backups report attestation accepts.")
+	pflag.DurationVar(&policyRetention, "policy-retention", 35*24*time.Hour, "Period report attestation attests, backups must be kept this long.")
+	pflag.StringVar(&verify, "verify", "", "Verify the archive after download, supported: deep (git fsck and ref counts against the live repositories).")
+	pflag.DurationVar(&maxLock, "max-lock-duration", 0, "Unlock repositories locked with --lock after this long (e.g. 1h), even if the backup isn't finished, and mark the run degraded.")
+	pflag.DurationVar(&stuckAfter, "stuck-after", 0, "Delete and restart a migration that isn't exported after this long (e.g. 2h). Default: wait indefinitely")
+	pflag.IntVar(&attempts, "attempts", 3, "Migrations to start with --stuck-after before giving up.")
+	pflag.Float64Var(&rateLimitWarn, "rate-limit-warn", 0, "Warn if a backup uses more than this fraction (e.g. 0.5) of the REST or GraphQL rate limit. Default: don't warn")
+	pflag.IntVar(&failedRetries, "max-migration-retries", 0, "Start a new migration if GitHub fails to export one, up to this many times, waiting 1m, 2m, 4m, ... in between.")
+	pflag.DurationVar(&timeout, "timeout", 0, "Cancel the backup if it takes longer (e.g. 6h), unlocking repositories and deleting the migration. Default: no timeout")
+	pflag.StringVar(&window, "window", "", "Only start migrations within this daily window in local time (e.g. 22:00-06:00), waiting for it otherwise, also with serve. Default: any time")
+	pflag.StringVar(&oncePer, "once-per", "", "Skip the backup if one already succeeded this period according to the catalog: hour, day, or week.")
+	pflag.Int64Var(&migrationID, "migration-id", 0, "Migration the watch, unlock, and retry commands use.")
+	pflag.BoolVar(&forceUnlock, "force-unlock", false, "With --lock, unlock repositories still locked by a previous migration instead of failing.")
+	pflag.BoolVar(&unlockAll, "all", false, "Unlock repositories of all recent migrations with the unlock command.")
+	pflag.StringVar(&listen, "listen", ":8080", "Address the serve command listens on.")
+	pflag.StringSliceVar(&storageURLs, "storage", make([]string, 0), "Also store archives in this storage, can be provided multiple times: restic:<repository>, webdav:<url>, rclone:<remote>:<path>, gdrive:<folder-id>.")
+	pflag.IntVar(&uploadQuorum, "upload-quorum", 0, "Storages an archive must be uploaded to, failures on the others only mark the run degraded. Default: all")
+	pflag.StringVar(&textfilePath, "textfile-path", "", "Write Prometheus metrics for the node_exporter textfile collector to this path (e.g. /var/lib/node_exporter/textfile/ghec_backup.prom).")
+	pflag.StringVar(&statsdAddress, "statsd-address", "", "Send run metrics to a statsd or DogStatsD server (e.g. localhost:8125).")
+	pflag.StringVar(&auditLog, "audit-log", "", "Append every migration, lock, unlock, delete, and upload to this file as JSON lines.")
+	pflag.StringVar(&summaryJSON, "summary-json", "", "Write a machine-readable run summary to this path.")
+	pflag.StringVar(&reportPath, "report", "", "Write a human-readable run report to this path, HTML for .html, Markdown otherwise.")
+	pflag.BoolVar(&noColor, "no-color", false, "Disable colored output. Default: NO_COLOR environment variable")
+	pflag.BoolVar(&verbose, "verbose", false, "Log API calls, pagination, migration state changes, and cleanup with timestamps to stderr.")
+	pflag.CommandLine.SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		switch name {
+		case "force":
+			name = "yes"
+		case "repo":
+			name = "repository"
+		}
+		return pflag.NormalizedName(name)
+	})
 	pflag.Parse()
 
-	// read config
-	viper.SetConfigName(".ghec-backup")
-	viper.SetConfigType("yml")
+	command = pflag.Arg(0)
 
-	if cfg != "" {
-		viper.AddConfigPath(cfg)
-	} else {
-		viper.AddConfigPath(".")
+	if showVersion {
+		printVersion()
+		os.Exit(0)
+	}
+
+	if offlineCommands[command] {
+		if help {
+			printHelp()
+			os.Exit(0)
+		}
+
+		if err := newTransport(); err != nil {
+			printHelpOnError(err.Error())
+		}
+		return
 	}
 
-	if err := viper.ReadInConfig(); err != nil && cfg != "" {
-		printHelpOnError(
-			fmt.Sprintf("config file .ghec-backup not found in %s", cfg),
-		)
+	// read config
+	if err := readConfig(); err != nil {
+		printHelpOnError(err.Error())
 	}
 	viper.BindPFlags(pflag.CommandLine)
 
 	// assign values
 	help = viper.GetBool("help")
 	token = viper.GetString("token")
+	tokenFile = viper.GetString("token-file")
+	tokenStdin = viper.GetBool("token-stdin")
+	auth = viper.GetString("auth")
+	baseURL = viper.GetString("base-url")
+	uploadURL = viper.GetString("upload-url")
+	graphqlURL = viper.GetString("graphql-url")
+	proxy = viper.GetString("proxy")
+	caCert = viper.GetString("ca-cert")
+	clientCert = viper.GetString("client-cert")
+	clientKey = viper.GetString("client-key")
+	debugHTTP = viper.GetBool("debug-http")
 	organization = viper.GetString("organization")
+	user = viper.GetString("user")
+	includeGists = viper.GetBool("gists")
+	exportMeta = viper.GetBool("metadata")
+	exportSBOM = viper.GetBool("sbom")
+	exportInsights = viper.GetBool("insights")
+	destination = viper.GetString("destination")
 	repos = viper.GetStringSlice("repository")
+	labels = viper.GetStringSlice("label")
 	lock = viper.GetBool("lock")
+	pickRepos = viper.GetBool("interactive")
+	assumeYes = viper.GetBool("yes")
+	quiet = viper.GetBool("quiet")
+	verbose = viper.GetBool("verbose")
+	noColor = viper.GetBool("no-color")
+	progressFormat = viper.GetString("progress-format")
+	format = viper.GetString("format")
+	signingKey = viper.GetString("signing-key")
+	policyInterval = viper.GetDuration("policy-interval")
+	policyRetention = viper.GetDuration("policy-retention")
+	summaryJSON = viper.GetString("summary-json")
+	auditLog = viper.GetString("audit-log")
+	textfilePath = viper.GetString("textfile-path")
+	statsdAddress = viper.GetString("statsd-address")
+	sentryDSN = viper.GetString("sentry_dsn")
+	if sentryDSN == "" {
+		sentryDSN = os.Getenv("SENTRY_DSN")
+	}
+	reportPath = viper.GetString("report")
+	verify = viper.GetString("verify")
+	timeout = viper.GetDuration("timeout")
+	stuckAfter = viper.GetDuration("stuck-after")
+	maxLock = viper.GetDuration("max-lock-duration")
+	attempts = viper.GetInt("attempts")
+	failedRetries = viper.GetInt("max-migration-retries")
+	retryFailed = viper.GetBool("retry-failed")
+	rateLimitWarn = viper.GetFloat64("rate-limit-warn")
+	repoFilter.ExcludeArchived = viper.GetBool("exclude-archived")
+	repoFilter.ExcludeForks = viper.GetBool("exclude-forks")
+	repoFilter.Visibility = viper.GetString("visibility")
+	repoCacheTTL = viper.GetDuration("repository-cache-ttl")
+	uploadQuorum = viper.GetInt("upload-quorum")
+	storageURLs = viper.GetStringSlice("storage")
+	oncePer = viper.GetString("once-per")
+	window = viper.GetString("window")
+	listen = viper.GetString("listen")
+	migrationID = viper.GetInt64("migration-id")
+	unlockAll = viper.GetBool("all")
+	forceUnlock = viper.GetBool("force-unlock")
+	includeEmpty = viper.GetBool("include-empty")
+	serveToken = viper.GetString("serve_token")
+	webhookSecret = viper.GetString("webhook_secret")
+
+	// https://no-color.org
+	_, noColorEnv := os.LookupEnv("NO_COLOR")
+	colorOutput = interactive && !noColor && !noColorEnv
+
+	readHooks()
+	readPlugins()
+	readNeverBackup()
+
+	for _, v := range storageURLs {
+		s, err := newStorage(v)
+		if err != nil {
+			printHelpOnError(err.Error())
+		}
+		storages = append(storages, s)
+	}
+
+	if viper.IsSet("token_source") {
+		tokenSource = &TokenSource{}
+		if err := viper.UnmarshalKey("token_source", tokenSource); err != nil {
+			printHelpOnError(fmt.Sprintf("invalid token_source: %s", err))
+		}
+	}
+
+	if err := newTransport(); err != nil {
+		printHelpOnError(err.Error())
+	}
+
+	if !localCommands[command] {
+		if err := readToken(); err != nil {
+			printHelpOnError(err.Error())
+		}
+	}
 
 	// validate
 	validateFlags()
 
+	if localCommands[command] {
+		return
+	}
+
 	// -----
 
 	src := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
-	httpClient = oauth2.NewClient(ctx, src)
+	httpClient = oauth2.NewClient(
+		context.WithValue(ctx, oauth2.HTTPClient, downloadClient),
+		src,
+	)
 
-	graphqlClient = graphql.NewClient(httpClient)
-	restClient = rest.NewClient(httpClient)
+	if err := newClients(); err != nil {
+		printHelpOnError(err.Error())
+	}
+
+	if user != "" {
+		if err := useUserMigrations(); err != nil {
+			printHelpOnError(err.Error())
+		}
+	}
 }
 
 func main() {
-	now := time.Now()
+	defer reportPanic()
 
-	if err := parseRepos(); err != nil {
-		errorAndExit(err)
+	switch command {
+	case "":
+		runBackup((&reporter{}).onEvent)
+	case "tui":
+		if err := tui(); err != nil {
+			errorAndExit(err)
+		}
+	case "doctor":
+		if !doctor() {
+			os.Exit(1)
+		}
+	case "init":
+		if err := initConfig(); err != nil {
+			errorAndExit(err)
+		}
+	case "completion":
+		if err := completion(pflag.Arg(1)); err != nil {
+			printHelpOnError(err.Error())
+		}
+	case "self-update":
+		if err := selfUpdate(); err != nil {
+			errorAndExit(err)
+		}
+	case "drill":
+		if err := drill(pflag.Arg(1)); err != nil {
+			errorAndExit(err)
+		}
+	case "watch":
+		if err := watch(migrationID); err != nil {
+			errorAndExit(err)
+		}
+	case "unlock":
+		if err := unlockRepositories(migrationID, unlockAll); err != nil {
+			errorAndExit(err)
+		}
+	case "retry":
+		if retryID = migrationID; retryID == 0 {
+			p, err := loadPending(destination, organization)
+			if err != nil {
+				errorAndExit(err)
+			}
+			retryID = p.MigrationID
+		}
+		runBackup((&reporter{}).onEvent)
+	case "serve":
+		if err := serve(); err != nil {
+			errorAndExit(err)
+		}
+	case "report":
+		if pflag.Arg(1) == "attestation" {
+			compliant, err := attest()
+			if err != nil {
+				errorAndExit(err)
+			}
+			if !compliant {
+				os.Exit(1)
+			}
+			break
+		}
+
+		if err := report(pflag.Arg(1)); err != nil {
+			printHelpOnError(err.Error())
+		}
+	case "catalog":
+		if err := catalog(pflag.Arg(1)); err != nil {
+			printHelpOnError(err.Error())
+		}
+	case "hold":
+		if err := hold(pflag.Arg(1), pflag.Arg(2)); err != nil {
+			errorAndExit(err)
+		}
+	case "diff":
+		if err := diffBackups(pflag.Arg(1), pflag.Arg(2)); err != nil {
+			printHelpOnError(err.Error())
+		}
+	default:
+		printHelpOnError(fmt.Sprintf("unknown command %q", command))
 	}
+}
 
-	m, _, err := restClient.Migrations.StartMigration(
-		ctx,
-		organization,
-		repos,
-		&rest.MigrationOptions{
-			LockRepositories:   lock,
-			ExcludeAttachments: true,
-		},
-	)
+// runBackup runs the backup, reporting its progress to onEvent.
+func runBackup(onEvent func(backup.Event)) {
+	now := time.Now()
 
-	if err != nil {
+	// before the summary, so we don't overwrite the one of the running backup
+	if err := acquireRunLock(organization); err != nil {
 		errorAndExit(err)
 	}
+	defer releaseRunLock()
 
-	id := m.GetID()
+	if oncePer != "" && retryID == 0 {
+		archive, err := existingBackup(destination, organization, oncePer)
+		if err != nil {
+			errorAndExit(err)
+		}
 
-	fmt.Printf("Creating backup archive (%v) ", id)
-	for {
-		exported, err := getMigrationStatus(id)
+		if archive != "" {
+			if jsonProgress() {
+				emit(eventSkipped, map[string]interface{}{"organization": organization, "file": archive, "period": oncePer})
+				return
+			}
+
+			fmt.Printf("Skipped backup of %s, %s was already downloaded this %s\n", organization, archive, oncePer)
+			return
+		}
+	}
 
+	if retryFailed && retryID == 0 {
+		failed, err := failedRepositories(destination, organization)
 		if err != nil {
 			errorAndExit(err)
 		}
 
-		if exported {
-			break
+		if len(failed) == 0 {
+			if jsonProgress() {
+				emit(eventSkipped, map[string]interface{}{"organization": organization, "reason": "no failed repositories"})
+				return
+			}
+
+			fmt.Printf("Skipped backup of %s, no repositories failed in the last backup\n", organization)
+			return
 		}
 
-		// sleep 3.6s to not hit (abuse) rate limit
-		time.Sleep(3600 * time.Millisecond)
+		printf("Retrying %d failed repositories of the last backup\n", len(failed))
+		repos = failed
 	}
-	fmt.Printf(" complete\n")
 
-	// download backup archive
-	url, _ := restClient.Migrations.MigrationArchiveURL(ctx, organization, id)
-	e := DownloadFile(
-		fmt.Sprintf("backup.%v.tar.gz", now.Unix()),
-		url,
-	)
+	if pickRepos && retryID == 0 {
+		names, _, err := listRepositories(nil)
+		if err != nil {
+			errorAndExit(err)
+		}
 
-	if e != nil {
-		errorAndExit(e)
+		if repos, err = pickRepositories(names, repos); err != nil {
+			errorAndExit(err)
+		}
 	}
 
-	// unlock repositories if they were locked for backup
-	if lock {
-		for _, r := range repos {
-			restClient.Migrations.UnlockRepo(ctx, organization, id, r)
-			fmt.Printf("%v/%v unlocked\n", organization, r)
+	var empty []string
+	if lock && retryID == 0 && prompting() {
+		// listed to count them, and passed on so they aren't listed twice
+		if len(repos) == 0 {
+			names, e, err := listRepositories(nil)
+			if err != nil {
+				errorAndExit(err)
+			}
+			repos, empty = names, e
+		}
+
+		if !confirmLock(len(repos)) {
+			fmt.Println("Aborted")
+			return
 		}
 	}
 
-	// delete archive
-	fmt.Printf("Cleaning up (%v)", id)
-	restClient.Migrations.DeleteMigration(
-		ctx,
+	if retryID != 0 && !confirmDelete(retryID) {
+		fmt.Println("Aborted")
+		return
+	}
+
+	res, err := backupOrganization(ctx, repos, empty, onEvent)
+	if err != nil {
+		errorAndExit(err)
+	}
+
+	if jsonProgress() {
+		emit(eventDone, map[string]interface{}{
+			"organization":     organization,
+			"migration_id":     res.MigrationID,
+			"repositories":     len(res.Repositories),
+			"file":             res.Path,
+			"bytes":            res.Bytes,
+			"duration_seconds": int(time.Since(now).Seconds()),
+		})
+		return
+	}
+
+	fmt.Printf(
+		"Backed up %d repositories of %s to %s (%s) in %s\n",
+		len(res.Repositories),
 		organization,
-		id,
+		res.Path,
+		humanize.Bytes(res.Bytes),
+		time.Since(now).Round(time.Second),
 	)
-	fmt.Printf(" complete\n")
 }
 
-// helpers ---------------------------------------------------------------------
+// backupOrganization backs up repos of organization, or all of them unless
+// they were listed already with the empty ones skipped, with the summary,
+// hooks, storages, and notifications of a run. The caller holds the run lock
+// and records a failure with failRun.
+func backupOrganization(ctx context.Context, repos, empty []string, onEvent func(backup.Event)) (*backup.Result, error) {
+	now := time.Now()
 
-func parseRepos() (err error) {
-	if len(repos) == 0 {
-		variables := map[string]interface{}{
-			"login": graphql.String(organization),
-			"page":  (*graphql.String)(nil),
+	// listed here rather than by the library, to be cached and resumable
+	if len(repos) == 0 && len(empty) == 0 && retryID == 0 {
+		names, e, err := listRepositories(onEvent)
+		if err != nil {
+			return nil, err
 		}
+		repos, empty = names, e
+	}
+
+	if len(repos) == 0 && len(empty) > 0 {
+		return nil, fmt.Errorf("all %d repositories of %s are empty, backup them with --include-empty", len(empty), organization)
+	}
+
+	var excluded []string
+	if retryID == 0 {
+		if repos, excluded = excludeNeverBackup(repos); len(repos) == 0 && len(excluded) > 0 {
+			return nil, fmt.Errorf("all %d repositories of %s match never_backup", len(excluded), organization)
+		}
+	}
+
+	// a repository locked already fails the export with a less helpful error
+	if lock && retryID == 0 {
+		if err := checkLocked(repos); err != nil {
+			return nil, err
+		}
+	}
+
+	summary = newSummary()
+
+	if len(excluded) > 0 {
+		summary.Excluded = excluded
+		printf("Excluding %d repositories matching never_backup\n", len(excluded))
+		verbosef("never_backup excludes %s", strings.Join(excluded, ", "))
+	}
+
+	if len(empty) > 0 {
+		summary.Empty = empty
+		printf("Skipping %d empty repositories\n", len(empty))
+		verbosef("empty repositories: %s", strings.Join(empty, ", "))
+	}
+
+	limits, err := rateLimits()
+	if err != nil {
+		verbosef("rate limits: %s", err)
+	}
 
-		var repositories []Repository
+	if err := runHooks("pre", hooks.Pre, summary); err != nil {
+		return nil, err
+	}
 
-		for {
-			err = graphqlClient.Query(ctx, &query, variables)
+	path := archivePath(destination, organization, now)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
 
-			repositories = append(repositories, query.Organization.Repositories.Nodes...)
+	runCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-			// break on last page
-			if !query.Organization.Repositories.PageInfo.HasNextPage {
-				break
+	opts := backup.Options{
+		Organization:    organization,
+		Repositories:    repos,
+		Filter:          repoFilter,
+		Lock:            lock,
+		Path:            path,
+		Verify:          verify == "deep",
+		StuckAfter:      stuckAfter,
+		Attempts:        attempts,
+		FailedRetries:   failedRetries,
+		MaxLockDuration: maxLock,
+		Window:          runWindow,
+		OnEvent:         onEvent,
+		AfterDownload: func(res *backup.Result) error {
+			checksum, err := fileChecksum(res.Path)
+			if err != nil {
+				return err
 			}
 
-			variables["page"] = graphql.NewString(query.Organization.Repositories.PageInfo.EndCursor)
+			locations, warnings, err := uploadChecksummed(runCtx, res.Path, checksum)
+			if summary.Archive != nil {
+				summary.Archive.SHA256, summary.Archive.Locations = checksum, locations
+			}
+			summary.Warnings = append(summary.Warnings, warnings...)
+			return err
+		},
+	}
+
+	var res *backup.Result
+
+	if retryID != 0 {
+		res, err = client.Retry(runCtx, opts, retryID)
+	} else {
+		res, err = client.Backup(runCtx, opts)
+	}
+
+	var kept *backup.KeptError
+	if errors.As(err, &kept) {
+		if err := savePending(destination, organization, kept.MigrationID, kept.Err); err != nil {
+			printError(err)
+		}
+		return nil, fmt.Errorf("%s, retry with: ghec-backup retry", err)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("backup timed out after %s", timeout)
+	}
+
+	var failed *backup.MigrationFailedError
+	if errors.As(err, &failed) {
+		verbosef("migration %d (guid %s) failed exporting %s", failed.MigrationID, failed.GUID, strings.Join(failed.Repositories, ", "))
+		summary.setRepositoryStatus("failed")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	summary.MigrationID = res.MigrationID
+	summary.DownloadSeconds = res.DownloadDuration.Seconds()
+	summary.setRepositorySizes(res.Sizes)
+	clearPending(destination, organization)
+
+	if includeGists {
+		if err := archiveGists(runCtx, res.Path); err != nil {
+			return nil, err
 		}
+	}
+
+	if exportMeta {
+		if err := exportMetadata(runCtx, res.Path, res.Repositories); err != nil {
+			return nil, err
+		}
+	}
 
-		for _, repo := range repositories {
-			repos = append(repos, repo.Name)
+	if exportSBOM {
+		if err := archiveSBOMs(runCtx, res.Path, res.Repositories); err != nil {
+			return nil, err
 		}
 	}
 
-	return
+	if exportInsights {
+		if err := captureInsights(runCtx, res.Path, res.Repositories); err != nil {
+			return nil, err
+		}
+	}
+
+	// the exports record failed requests as warnings, but a timeout fails the run
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("backup timed out after %s", timeout)
+	} else if err := runCtx.Err(); err != nil {
+		return nil, err
+	}
+
+	reportRateLimits(limits)
+
+	if err := summary.finish(nil); err != nil {
+		return nil, err
+	}
+
+	if err := runHooks("post", hooks.Post, summary); err != nil {
+		return nil, err
+	}
+	notify(summary)
+
+	return res, nil
 }
 
-func getMigrationStatus(id int64) (exported bool, err error) {
-	status, _, err := restClient.Migrations.MigrationStatus(
-		ctx,
-		organization,
-		id,
-	)
+// helpers ---------------------------------------------------------------------
 
+// newTransport creates the transport shared by all clients, honoring --proxy
+// or the HTTPS_PROXY, HTTP_PROXY, and NO_PROXY environment variables, and the
+// TLS options for intercepting proxies and mTLS egress gateways.
+func newTransport() error {
+	transport = http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig, err := newTLSConfig()
 	if err != nil {
-		return false, err
+		return err
 	}
+	transport.TLSClientConfig = tlsConfig
 
-	s := status.GetState()
+	// the cloned default transport already honors the proxy environment
+	if proxy != "" {
+		if _, err := parseEndpoint("proxy", proxy); err != nil {
+			return err
+		}
 
-	fmt.Printf(".")
+		proxyCfg := httpproxy.FromEnvironment()
+		proxyCfg.HTTPProxy = proxy
+		proxyCfg.HTTPSProxy = proxy
 
-	if s == "failed" {
-		return false, err
+		proxyFunc := proxyCfg.ProxyFunc()
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			return proxyFunc(r.URL)
+		}
 	}
 
-	return s == "exported", nil
-}
+	// the archive is served from pre-signed storage URLs, so downloads don't
+	// carry the token but still go through the same transport
+	downloadClient = &http.Client{
+		Transport: &loggingTransport{next: transport, debug: debugHTTP || verbose},
+	}
 
-// WriteCounter counts the number of bytes written to it. It implements to the io.Writer interface
-// and we can pass this into io.TeeReader() which will report progress on each write cycle.
-type WriteCounter struct {
-	Total uint64
+	return nil
 }
 
-func (wc *WriteCounter) Write(p []byte) (int, error) {
-	n := len(p)
-	wc.Total += uint64(n)
-	wc.PrintProgress()
-	return n, nil
-}
+func newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+
+		// trust the bundle in addition to the system roots
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
 
-// PrintProgress unexported
-func (wc WriteCounter) PrintProgress() {
-	// Clear the line by using a character return to go back to the start and remove
-	// the remaining characters by filling it with spaces
-	fmt.Printf("\r%s", strings.Repeat(" ", 35))
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
 
-	// Return again and print current status of download
-	// We use the humanize package to print the bytes in a meaningful way (e.g. 10 MB)
-	fmt.Printf("\rDownloading %s", humanize.Bytes(wc.Total))
+	if (clientCert == "") != (clientKey == "") {
+		return nil, errors.New("--client-cert and --client-key must be provided together")
+	}
+
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
-// DownloadFile will download a url to a local file. It's efficient because it will
-// write as it downloads and not load the whole file into memory. We pass an io.TeeReader
-// into Copy() to report progress on the download.
-func DownloadFile(filepath string, url string) error {
+// newClients creates the API clients for github.com, GitHub Enterprise Server,
+// or a GHE.com data residency subdomain.
+func newClients() (err error) {
+	if baseURL == "" {
+		if uploadURL != "" || graphqlURL != "" {
+			return errors.New("--upload-url and --graphql-url require --base-url")
+		}
+
+		client = backup.NewClient(httpClient, downloadClient)
+	} else {
+		for name, raw := range map[string]string{"base-url": baseURL, "upload-url": uploadURL, "graphql-url": graphqlURL} {
+			if _, err := parseEndpoint(name, raw); raw != "" && err != nil {
+				return err
+			}
+		}
+
+		if client, err = backup.NewEnterpriseClient(baseURL, uploadURL, graphqlURL, httpClient, downloadClient); err != nil {
+			return err
+		}
+	}
+
+	client.REST.UserAgent = userAgent()
+
+	return nil
+}
 
-	// Create the file, but give it a tmp file extension, this means we won't overwrite a
-	// file until it's downloaded, but we'll remove the tmp extension once downloaded.
-	out, err := os.Create(filepath + ".tmp")
+// useUserMigrations backs up the repositories of --user with the user
+// migrations API, which only exports the authenticated user's repositories.
+func useUserMigrations() error {
+	u, _, err := client.REST.Users.Get(ctx, "")
 	if err != nil {
 		return err
 	}
 
-	// Get the data
-	resp, err := http.Get(url)
+	if !strings.EqualFold(u.GetLogin(), user) {
+		return fmt.Errorf("--user %s must be the authenticated user, the token belongs to %s", user, u.GetLogin())
+	}
+
+	client.Migrations = backup.UserMigrations(client.REST.Migrations)
+
+	return nil
+}
+
+// parseEndpoint validates the URL given for flag name.
+func parseEndpoint(name, raw string) (*url.URL, error) {
+	u, err := backup.ParseEndpoint(raw)
 	if err != nil {
-		out.Close()
-		return err
+		return nil, fmt.Errorf("invalid --%s: %s", name, err)
 	}
-	defer resp.Body.Close()
 
-	// Create our progress reporter and pass it to be used alongside our writer
-	counter := &WriteCounter{}
-	if _, err = io.Copy(out, io.TeeReader(resp.Body, counter)); err != nil {
-		out.Close()
-		return err
+	return u, nil
+}
+
+// readToken reads the token from --token-file, --token-stdin, --auth, or the
+// token_source config block so it never has to appear in argv, process
+// listings, or shell history.
+func readToken() (err error) {
+	sources := 0
+	for _, set := range []bool{tokenFile != "", tokenStdin, auth != "", tokenSource != nil} {
+		if set {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		return errors.New("--token-file, --token-stdin, --auth, and token_source are mutually exclusive")
 	}
 
-	// The progress use the same line so print a new line once it's finished downloading
-	fmt.Print("\n")
+	var b []byte
+
+	switch {
+	case tokenFile != "":
+		b, err = ioutil.ReadFile(tokenFile)
+	case tokenStdin:
+		b, err = ioutil.ReadAll(os.Stdin)
+	case auth == "gh":
+		// gh resolves the token from its config file or the system keyring
+		args := []string{"auth", "token"}
+		if baseURL != "" {
+			u, err := url.Parse(baseURL)
+			if err != nil {
+				return err
+			}
+
+			host := u.Hostname()
+			if sub := backup.DataResidencyDomain(u); sub != "" {
+				host = sub
+			}
+			args = append(args, "--hostname", host)
+		}
 
-	// Close the file without defer so it can happen before Rename()
-	out.Close()
+		if b, err = exec.Command("gh", args...).Output(); err != nil {
+			return fmt.Errorf("gh auth token: %s", err)
+		}
+	case tokenSource != nil:
+		t, err := tokenSource.Fetch()
+		if err != nil {
+			return err
+		}
+		b = []byte(t)
+	case auth != "":
+		return fmt.Errorf("unsupported auth %q, must be gh", auth)
+	default:
+		return nil
+	}
 
-	if err = os.Rename(filepath+".tmp", filepath); err != nil {
+	if err != nil {
 		return err
 	}
+
+	token = strings.TrimSpace(string(b))
+
 	return nil
 }
 
@@ -292,33 +927,166 @@ func validateFlags() {
 		os.Exit(0)
 	}
 
-	if token == "" {
+	if token == "" && !localCommands[command] {
 		printHelpOnError("token missing")
 	}
 
-	if organization == "" {
+	if user != "" {
+		if organization != "" {
+			printHelpOnError("--organization and --user are mutually exclusive")
+		}
+
+		// the user's login takes the organization's place in paths and output
+		organization = user
+	}
+
+	// the catalog lists the backups of all organizations by default
+	if organization == "" && command != "catalog" {
 		printHelpOnError("organization is required")
 	}
+
+	if quiet && verbose {
+		printHelpOnError("--quiet and --verbose are mutually exclusive")
+	}
+
+	if verify != "" && verify != "deep" {
+		printHelpOnError(fmt.Sprintf("unsupported verify mode %q, must be deep", verify))
+	}
+
+	if oncePer != "" {
+		if err := validPeriod(oncePer); err != nil {
+			printHelpOnError(err.Error())
+		}
+	}
+
+	if window != "" {
+		var err error
+		if runWindow, err = backup.ParseWindow(window); err != nil {
+			printHelpOnError(err.Error())
+		}
+	}
+
+	if attempts < 1 {
+		printHelpOnError("--attempts must be at least 1")
+	}
+
+	if retryFailed && (len(repos) > 0 || pickRepos) {
+		printHelpOnError("--retry-failed can't be combined with --repository or --interactive")
+	}
+
+	for _, pattern := range neverBackup {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			printHelpOnError(fmt.Sprintf("invalid never_backup pattern %q", pattern))
+		}
+	}
+
+	switch repoFilter.Visibility {
+	case "", "public", "private", "internal":
+	default:
+		printHelpOnError(fmt.Sprintf("unsupported visibility %q, must be public, private, or internal", repoFilter.Visibility))
+	}
+
+	if rateLimitWarn < 0 || rateLimitWarn > 1 {
+		printHelpOnError("--rate-limit-warn must be between 0 and 1")
+	}
+
+	if failedRetries < 0 {
+		printHelpOnError("--max-migration-retries must not be negative")
+	}
+
+	if uploadQuorum < 0 || uploadQuorum > len(storages) {
+		printHelpOnError(fmt.Sprintf("--upload-quorum must be between 0 and the %d storages", len(storages)))
+	}
+
+	if progressFormat != "text" && progressFormat != "json" {
+		printHelpOnError(fmt.Sprintf("unsupported progress format %q, must be text or json", progressFormat))
+	}
+
+	for _, l := range labels {
+		if !labelPattern.MatchString(l) {
+			printHelpOnError(fmt.Sprintf("invalid label %q, must be letters, digits, ., _, or -", l))
+		}
+	}
+
+	if policyInterval <= 0 || policyRetention <= 0 {
+		printHelpOnError("--policy-interval and --policy-retention must be positive")
+	}
+
+	if format != "text" && format != "csv" {
+		printHelpOnError(fmt.Sprintf("unsupported format %q, must be text or csv", format))
+	}
+}
+
+// printf prints progress output, unless --quiet or --progress-format json is set.
+func printf(format string, a ...interface{}) {
+	if !quiet && !jsonProgress() {
+		fmt.Printf(format, a...)
+	}
+}
+
+// verbosef logs timestamped details to stderr if --verbose is set.
+func verbosef(format string, a ...interface{}) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format(time.RFC3339), redact(fmt.Sprintf(format, a...)))
+	}
 }
 
 func printHelp() {
 	fmt.Println(`USAGE:
-  ghec-backup [OPTIONS]
+  ghec-backup [COMMAND] [OPTIONS]
 
+COMMANDS:`)
+	for _, c := range commands {
+		fmt.Printf("  %-12s %s\n", c.name, c.usage)
+	}
+	fmt.Println(`
 OPTIONS:`)
 	pflag.PrintDefaults()
 	fmt.Println(`
 EXAMPLE:
-  $ ghec-backup`)
+  $ ghec-backup
+  $ ghec-backup doctor
+  $ ghec-backup completion bash > /etc/bash_completion.d/ghec-backup`)
 	fmt.Println()
 }
 
+func printVersion() {
+	fmt.Printf("ghec-backup %s\n", version)
+	fmt.Printf("  commit: %s\n", commit)
+	fmt.Printf("  built:  %s\n", date)
+	fmt.Printf("  go:     %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
 func printHelpOnError(s string) {
 	printHelp()
 	errorAndExit(errors.New(s))
 }
 
 func errorAndExit(err error) {
-	fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	emit(eventError, map[string]interface{}{"error": redact(err.Error())})
+	reportToSentry("error", fmt.Sprintf("%T", err), err, 1)
+
+	failRun(err)
+
+	printError(err)
 	os.Exit(2)
 }
+
+// failRun records err as the outcome of the running backup, runs the
+// on_failure hooks, notifies, and releases the run lock.
+func failRun(err error) {
+	// record the failure, unless writing the summary itself failed
+	if s := summary; s != nil {
+		summary = nil
+		if s.Status == "running" {
+			s.finish(err)
+
+			if err := runHooks("on_failure", hooks.OnFailure, s); err != nil {
+				printError(err)
+			}
+			notify(s)
+		}
+	}
+
+	releaseRunLock()
+}
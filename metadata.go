@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+// metadata is the supplementary export of repository settings migration
+// archives don't include, so they can be reapplied after a restore.
+type metadata struct {
+	Organization string                         `json:"organization"`
+	ExportedAt   time.Time                      `json:"exported_at"`
+	Repositories map[string]*repositoryMetadata `json:"repositories"`
+}
+
+// repositoryMetadata are the settings of a repository, nil sections aren't
+// configured.
+type repositoryMetadata struct {
+	Settings      *repositorySettings `json:"settings,omitempty"`
+	Pages         *pagesSettings      `json:"pages,omitempty"`
+	DeployKeys    []deployKey         `json:"deploy_keys,omitempty"`
+	Collaborators []collaborator      `json:"collaborators,omitempty"`
+}
+
+// deployKey is the public part of a deploy key.
+type deployKey struct {
+	Title    string `json:"title"`
+	Key      string `json:"key"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// collaborator is a user with direct access to a repository, not through a
+// team or as organization owner.
+type collaborator struct {
+	Login      string `json:"login"`
+	Permission string `json:"permission"`
+}
+
+// repositorySettings are the repository's own settings.
+type repositorySettings struct {
+	Description         string   `json:"description"`
+	Homepage            string   `json:"homepage"`
+	Topics              []string `json:"topics"`
+	Visibility          string   `json:"visibility,omitempty"`
+	DefaultBranch       string   `json:"default_branch"`
+	HasIssues           bool     `json:"has_issues"`
+	HasProjects         bool     `json:"has_projects"`
+	HasWiki             bool     `json:"has_wiki"`
+	IsTemplate          bool     `json:"is_template"`
+	Archived            bool     `json:"archived"`
+	AllowMergeCommit    bool     `json:"allow_merge_commit"`
+	AllowSquashMerge    bool     `json:"allow_squash_merge"`
+	AllowRebaseMerge    bool     `json:"allow_rebase_merge"`
+	AllowAutoMerge      bool     `json:"allow_auto_merge"`
+	DeleteBranchOnMerge bool     `json:"delete_branch_on_merge"`
+	VulnerabilityAlerts bool     `json:"vulnerability_alerts"`
+}
+
+// pagesSettings are the GitHub Pages settings of a repository.
+type pagesSettings struct {
+	Status    string `json:"status,omitempty"`
+	BuildType string `json:"build_type,omitempty"`
+	Source    *struct {
+		Branch string `json:"branch"`
+		Path   string `json:"path"`
+	} `json:"source,omitempty"`
+	CNAME         string `json:"cname,omitempty"`
+	HTTPSEnforced bool   `json:"https_enforced"`
+	Public        *bool  `json:"public,omitempty"`
+	HTMLURL       string `json:"html_url,omitempty"`
+}
+
+// metadataPath returns the path of the metadata export next to the migration
+// archive, metadata.<org>.<timestamp>.json.
+func metadataPath(archive string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(archive), "backup."), ".tar.gz")
+	return filepath.Join(filepath.Dir(archive), "metadata."+name+".json")
+}
+
+// exportMetadata exports the settings of repos next to the migration archive
+// and uploads them to the storages. Settings that can't be read are recorded
+// as warnings.
+func exportMetadata(ctx context.Context, archive string, repos []string) error {
+	path := metadataPath(archive)
+
+	m := &metadata{
+		Organization: organization,
+		ExportedAt:   time.Now().UTC(),
+		Repositories: map[string]*repositoryMetadata{},
+	}
+
+	var warnings []string
+
+	for _, repo := range repos {
+		rm := &repositoryMetadata{}
+		m.Repositories[repo] = rm
+
+		verbosef("metadata %s/%s: settings", organization, repo)
+
+		var err error
+		if rm.Settings, err = getRepositorySettings(ctx, repo); err != nil {
+			warnings = append(warnings, fmt.Sprintf("metadata %s/%s: settings: %s", organization, repo, err))
+		}
+
+		if rm.Pages, err = getPages(ctx, repo); err != nil {
+			warnings = append(warnings, fmt.Sprintf("metadata %s/%s: pages: %s", organization, repo, err))
+		}
+
+		if rm.DeployKeys, err = listDeployKeys(ctx, repo); err != nil {
+			warnings = append(warnings, fmt.Sprintf("metadata %s/%s: deploy keys: %s", organization, repo, err))
+		}
+
+		if rm.Collaborators, err = listCollaborators(ctx, repo); err != nil {
+			warnings = append(warnings, fmt.Sprintf("metadata %s/%s: collaborators: %s", organization, repo, err))
+		}
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	for _, w := range warnings {
+		printf("%s\n", colorize(colorRed, "Warning: "+w))
+	}
+	summary.Warnings = append(summary.Warnings, warnings...)
+	summary.Metadata = archiveSummary(path, uint64(len(b)+1))
+
+	printf("Exported settings of %d repositories to %s (%s)\n", len(repos), path, humanize.Bytes(uint64(len(b)+1)))
+	emit(eventMetadataExported, map[string]interface{}{"file": path, "repositories": len(repos)})
+
+	warnings, err = upload(ctx, path)
+	summary.Warnings = append(summary.Warnings, warnings...)
+
+	return err
+}
+
+// getRepositorySettings returns the settings of repo, including whether
+// Dependabot alerts are enabled. go-github's Repository lacks some of the
+// merge settings, so the response is decoded here.
+func getRepositorySettings(ctx context.Context, repo string) (*repositorySettings, error) {
+	settings := &repositorySettings{}
+
+	found, err := getResource(ctx, fmt.Sprintf("repos/%s/%s", organization, repo), settings)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if settings.VulnerabilityAlerts, _, err = client.REST.Repositories.GetVulnerabilityAlerts(ctx, organization, repo); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// getPages returns the Pages settings of repo, nil if Pages isn't enabled.
+// go-github's Pages lacks HTTPS enforcement, so the response is decoded here.
+func getPages(ctx context.Context, repo string) (*pagesSettings, error) {
+	pages := &pagesSettings{}
+
+	found, err := getResource(ctx, fmt.Sprintf("repos/%s/%s/pages", organization, repo), pages)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return pages, nil
+}
+
+// listDeployKeys returns the deploy keys of repo.
+func listDeployKeys(ctx context.Context, repo string) ([]deployKey, error) {
+	var keys []deployKey
+
+	opts := &rest.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.REST.Repositories.ListKeys(ctx, organization, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range page {
+			keys = append(keys, deployKey{Title: k.GetTitle(), Key: k.GetKey(), ReadOnly: k.GetReadOnly()})
+		}
+
+		if resp.NextPage == 0 {
+			return keys, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// permissions from highest to lowest
+var permissions = []string{"admin", "maintain", "push", "triage", "pull"}
+
+// listCollaborators returns the direct collaborators of repo with their
+// highest permission.
+func listCollaborators(ctx context.Context, repo string) ([]collaborator, error) {
+	var collaborators []collaborator
+
+	opts := &rest.ListCollaboratorsOptions{Affiliation: "direct", ListOptions: rest.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := client.REST.Repositories.ListCollaborators(ctx, organization, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range page {
+			c := collaborator{Login: u.GetLogin()}
+			if u.Permissions != nil {
+				for _, p := range permissions {
+					if (*u.Permissions)[p] {
+						c.Permission = p
+						break
+					}
+				}
+			}
+			collaborators = append(collaborators, c)
+		}
+
+		if resp.NextPage == 0 {
+			return collaborators, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// getResource reads the API resource at u into v, found is false if it
+// doesn't exist.
+func getResource(ctx context.Context, u string, v interface{}) (found bool, err error) {
+	req, err := client.REST.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := client.REST.Do(ctx, req, v); err != nil {
+		if e, ok := err.(*rest.ErrorResponse); ok && e.Response.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// periods supported by --once-per
+var periods = []string{"hour", "day", "week"}
+
+// periodStart returns the start of the period containing t, weeks start on
+// Monday.
+func periodStart(t time.Time, period string) time.Time {
+	switch period {
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// existingBackup returns the archive of the last successful or degraded
+// backup of org in the catalog of dest finished during the current period,
+// or an empty string if there is none. Archives of failed runs, e.g. with a
+// failed upload, don't count, runs with any --label do.
+func existingBackup(dest, org, period string) (string, error) {
+	entries, err := readCatalogEntries(dest)
+	if err != nil {
+		return "", err
+	}
+
+	start := periodStart(time.Now(), period)
+	archive := ""
+
+	for _, e := range entries {
+		if !strings.EqualFold(e.Organization, org) || e.Archive == "" || (e.Status != "success" && e.Status != "degraded") {
+			continue
+		}
+
+		finished := e.StartedAt.Add(time.Duration(e.DurationSeconds * float64(time.Second)))
+		if !finished.Before(start) {
+			archive = e.Archive
+		}
+	}
+
+	return archive, nil
+}
+
+// validPeriod reports whether period is supported by --once-per.
+func validPeriod(period string) error {
+	for _, p := range periods {
+		if p == period {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported period %q, must be hour, day, or week", period)
+}
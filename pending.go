@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pendingMigration is an exported migration kept on GitHub after its
+// download failed, so the retry command doesn't have to export it again.
+type pendingMigration struct {
+	MigrationID int64     `json:"migration_id"`
+	Error       string    `json:"error"`
+	FailedAt    time.Time `json:"failed_at"`
+}
+
+// pendingPath is the state file of the kept migration of org.
+func pendingPath(dest, org string) string {
+	return filepath.Join(dest, org, ".pending-migration.json")
+}
+
+func savePending(dest, org string, id int64, err error) error {
+	b, _ := json.MarshalIndent(pendingMigration{MigrationID: id, Error: redact(err.Error()), FailedAt: time.Now().UTC()}, "", "  ")
+
+	if err := os.MkdirAll(filepath.Join(dest, org), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(pendingPath(dest, org), append(b, '\n'), 0644)
+}
+
+func loadPending(dest, org string) (*pendingMigration, error) {
+	b, err := ioutil.ReadFile(pendingPath(dest, org))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no failed download of %s to retry", org)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var p pendingMigration
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %s", pendingPath(dest, org), err)
+	}
+
+	return &p, nil
+}
+
+func clearPending(dest, org string) {
+	os.Remove(pendingPath(dest, org))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pickLimit is the number of matching repositories listed at once.
+const pickLimit = 20
+
+// pickRepositories lets the user filter names with a fuzzy search and toggle
+// the repositories to backup, preselected are selected initially.
+func pickRepositories(names, preselected []string) ([]string, error) {
+	if !isTerminal(os.Stdin) {
+		return nil, errors.New("--interactive requires an interactive terminal")
+	}
+
+	sort.Strings(names)
+
+	selected := map[string]bool{}
+	for _, name := range preselected {
+		selected[name] = true
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	filter := ""
+
+	for {
+		var matches []string
+		for _, name := range names {
+			if fuzzyMatch(name, filter) {
+				matches = append(matches, name)
+			}
+		}
+
+		fmt.Println()
+		for i, name := range matches {
+			if i == pickLimit {
+				fmt.Printf("  ... %d more, type to filter\n", len(matches)-pickLimit)
+				break
+			}
+
+			mark := " "
+			if selected[name] {
+				mark = "x"
+			}
+			fmt.Printf("  [%s] %2d %s\n", mark, i+1, name)
+		}
+		fmt.Printf("%d of %d repositories selected\n", len(selected), len(names))
+
+		answer := prompt(in, "Filter, numbers to toggle (e.g. 1 3-5), all, none, or enter to start", "")
+
+		switch answer {
+		case "":
+			if len(selected) == 0 {
+				fmt.Println("Select at least one repository")
+				continue
+			}
+
+			picked := make([]string, 0, len(selected))
+			for _, name := range names {
+				if selected[name] {
+					picked = append(picked, name)
+				}
+			}
+			return picked, nil
+		case "all":
+			for _, name := range matches {
+				selected[name] = true
+			}
+		case "none":
+			for _, name := range matches {
+				delete(selected, name)
+			}
+		default:
+			indexes, ok := parseSelection(answer, len(matches))
+			if !ok {
+				filter = answer
+				continue
+			}
+
+			for _, i := range indexes {
+				if name := matches[i]; selected[name] {
+					delete(selected, name)
+				} else {
+					selected[name] = true
+				}
+			}
+		}
+	}
+}
+
+// parseSelection parses space or comma separated numbers and ranges (e.g.
+// "1 3-5") into zero-based indexes below n.
+func parseSelection(s string, n int) ([]int, bool) {
+	var indexes []int
+
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' }) {
+		from, to := f, f
+		if i := strings.Index(f, "-"); i > 0 {
+			from, to = f[:i], f[i+1:]
+		}
+
+		a, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, false
+		}
+
+		b, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, false
+		}
+
+		if a < 1 || b > n || a > b {
+			return nil, false
+		}
+
+		for i := a; i <= b; i++ {
+			indexes = append(indexes, i-1)
+		}
+	}
+
+	return indexes, len(indexes) > 0
+}
+
+// fuzzyMatch reports whether the characters of filter appear in name in
+// order, ignoring case.
+func fuzzyMatch(name, filter string) bool {
+	name, filter = strings.ToLower(name), strings.ToLower(filter)
+
+	for _, r := range filter {
+		i := strings.IndexRune(name, r)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(string(r)):]
+	}
+
+	return true
+}
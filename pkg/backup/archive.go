@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ArchiveRepositories returns the repositories in a migration archive with the
+// size of their git data, including wikis. Archives store each repository as
+// a bare git directory at repositories/<owner>/<name>.git.
+func ArchiveRepositories(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	sizes := map[string]uint64{}
+
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := archiveRepositoryName(h.Name)
+		if name == "" {
+			continue
+		}
+
+		sizes[name] += uint64(h.Size)
+	}
+
+	return sizes, nil
+}
+
+// MissingRepositories returns the repositories of names a migration archive
+// doesn't contain.
+func MissingRepositories(path string, names []string) ([]string, error) {
+	sizes, err := ArchiveRepositories(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return missingRepositories(sizes, names), nil
+}
+
+// missingRepositories returns the repositories of names sizes has none for.
+func missingRepositories(sizes map[string]uint64, names []string) []string {
+	// repository names are case-insensitive
+	archived := make(map[string]bool, len(sizes))
+	for name := range sizes {
+		archived[strings.ToLower(name)] = true
+	}
+
+	var missing []string
+	for _, name := range names {
+		if !archived[strings.ToLower(name)] {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// archiveRepositoryName returns the repository an archive entry belongs to,
+// or an empty string for entries outside of repositories/.
+func archiveRepositoryName(entry string) string {
+	parts := strings.Split(strings.TrimPrefix(entry, "./"), "/")
+	if len(parts) < 3 || parts[0] != "repositories" || !strings.HasSuffix(parts[2], ".git") {
+		return ""
+	}
+
+	name := strings.TrimSuffix(parts[2], ".git")
+	return strings.TrimSuffix(name, ".wiki")
+}
+
+// ExtractRepositories extracts the git data under repositories/ from a
+// migration archive into dir. If names is not nil, only those repositories
+// (and their wikis) are extracted.
+func ExtractRepositories(path, dir string, names map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := archiveRepositoryName(h.Name)
+		if name == "" || (names != nil && !names[name]) {
+			continue
+		}
+
+		// never write outside of dir
+		target := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(h.Name, "./")))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid archive entry %s", h.Name)
+		}
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		}
+	}
+}
@@ -0,0 +1,504 @@
+// Package backup creates organization backups with the GitHub migrations API.
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	rest "github.com/google/go-github/v31/github"
+	graphql "github.com/shurcooL/githubv4"
+)
+
+// DefaultPollInterval between migration status requests, chosen to not hit
+// the (abuse) rate limit.
+const DefaultPollInterval = 3600 * time.Millisecond
+
+// DefaultFailedBackoff before the first new migration after one failed.
+const DefaultFailedBackoff = time.Minute
+
+// Client runs backups against github.com, GitHub Enterprise Server, or GHE.com.
+type Client struct {
+	// Migrations and GraphQL send authenticated API requests
+	Migrations Migrations
+	GraphQL    Querier
+
+	// Download fetches archives from their pre-signed storage URLs, it must
+	// not send the token
+	Download Downloader
+
+	// REST is the underlying API client, nil if created with New
+	REST *rest.Client
+}
+
+// Options configure a backup.
+type Options struct {
+	// Organization to backup
+	Organization string
+
+	// Repositories to backup, default: all organization repositories that
+	// match Filter
+	Repositories []string
+	Filter       RepositoryFilter
+
+	// Lock repositories while backing up
+	Lock bool
+
+	// Path to write the archive to
+	Path string
+
+	// Verify extracts the archive after download and checks each repository
+	// with git fsck and its ref counts against the live repository
+	Verify bool
+
+	// PollInterval between migration status requests, default: DefaultPollInterval
+	PollInterval time.Duration
+
+	// StuckAfter abandons a migration that isn't exported after this long and
+	// starts a new one, up to Attempts times. Default: wait indefinitely
+	StuckAfter time.Duration
+	Attempts   int
+
+	// FailedRetries starts a new migration if GitHub failed to export one, up
+	// to this many times, after FailedBackoff, doubled after each retry.
+	// Default: fail right away, DefaultFailedBackoff
+	FailedRetries int
+	FailedBackoff time.Duration
+
+	// MaxLockDuration unlocks the repositories if the backup takes longer,
+	// even though the migration isn't finished, and marks the result
+	// Degraded. Default: locked until downloaded
+	MaxLockDuration time.Duration
+
+	// Window only starts migrations, also new attempts, within the window and
+	// waits for it otherwise. Default: any time
+	Window *Window
+
+	// AfterDownload is called with the downloaded archive before the
+	// migration is deleted, e.g. to upload it. An error keeps the migration
+	// like a failed download
+	AfterDownload func(*Result) error
+
+	// OnEvent is called for every step of the backup
+	OnEvent func(Event)
+}
+
+// ErrMigrationStuck is returned if no migration was exported within
+// Options.StuckAfter in any of the attempts.
+var ErrMigrationStuck = errors.New("migration stuck")
+
+// KeptError is returned if the download of an exported migration failed, the
+// migration and its archive are kept on GitHub to be downloaded with Retry.
+type KeptError struct {
+	MigrationID int64
+	Err         error
+}
+
+func (e *KeptError) Error() string {
+	return fmt.Sprintf("%s (migration %d kept for retry)", e.Err, e.MigrationID)
+}
+
+func (e *KeptError) Unwrap() error {
+	return e.Err
+}
+
+// Result describes a completed backup.
+type Result struct {
+	MigrationID      int64
+	Attempts         int
+	Repositories     []string
+	Path             string
+	Bytes            uint64
+	ExportDuration   time.Duration
+	DownloadDuration time.Duration
+
+	// Degraded if the repositories were unlocked after MaxLockDuration,
+	// before the archive was downloaded
+	Degraded bool
+
+	// Missing are the repositories of the migration the archive doesn't
+	// contain
+	Missing []string
+
+	// Sizes of the git data of the repositories in the archive, including
+	// wikis, see ArchiveRepositories
+	Sizes map[string]uint64
+}
+
+// New creates a client from its operations, e.g. to run backups against a
+// mock implementation.
+func New(migrations Migrations, graphql Querier, download Downloader) *Client {
+	return &Client{
+		Migrations: migrations,
+		GraphQL:    graphql,
+		Download:   download,
+	}
+}
+
+// NewClient creates a client for github.com. httpClient must authenticate
+// requests, download is used for the unauthenticated archive download.
+func NewClient(httpClient, download *http.Client) *Client {
+	r := rest.NewClient(httpClient)
+
+	return &Client{
+		Migrations: r.Migrations,
+		GraphQL:    graphql.NewClient(httpClient),
+		Download:   download,
+		REST:       r,
+	}
+}
+
+// NewEnterpriseClient creates a client for GitHub Enterprise Server or a
+// GHE.com data residency subdomain. uploadURL and graphqlURL are derived from
+// baseURL if empty.
+func NewEnterpriseClient(baseURL, uploadURL, graphqlURL string, httpClient, download *http.Client) (*Client, error) {
+	base, err := ParseEndpoint(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var upload *url.URL
+	if uploadURL != "" {
+		if upload, err = ParseEndpoint(uploadURL); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Client{Download: download}
+	defaultGraphqlURL := ""
+
+	if sub := DataResidencyDomain(base); sub != "" {
+		// GHE.com serves the API from api.<subdomain>.ghe.com without a path prefix
+		c.REST = rest.NewClient(httpClient)
+		c.REST.BaseURL, _ = url.Parse("https://api." + sub + "/")
+		c.REST.UploadURL, _ = url.Parse("https://uploads." + sub + "/")
+
+		if upload != nil {
+			c.REST.UploadURL = upload
+		}
+
+		defaultGraphqlURL = "https://api." + sub + "/graphql"
+	} else {
+		if uploadURL == "" {
+			uploadURL = baseURL
+		}
+
+		if c.REST, err = rest.NewEnterpriseClient(baseURL, uploadURL, httpClient); err != nil {
+			return nil, err
+		}
+
+		// GitHub Enterprise Server serves GraphQL at /api/graphql next to /api/v3
+		defaultGraphqlURL = strings.TrimSuffix(c.REST.BaseURL.String(), "v3/") + "graphql"
+	}
+
+	if graphqlURL == "" {
+		graphqlURL = defaultGraphqlURL
+	} else if _, err = ParseEndpoint(graphqlURL); err != nil {
+		return nil, err
+	}
+
+	c.Migrations = c.REST.Migrations
+	c.GraphQL = graphql.NewEnterpriseClient(graphqlURL, httpClient)
+
+	return c, nil
+}
+
+// ParseEndpoint validates an API endpoint is an absolute http(s) URL.
+func ParseEndpoint(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("%q must be an absolute http(s) URL", raw)
+	}
+
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+
+	return u, nil
+}
+
+// DataResidencyDomain returns the <subdomain>.ghe.com host for GHE.com URLs,
+// or an empty string for any other host.
+func DataResidencyDomain(u *url.URL) string {
+	host := u.Hostname()
+	if !strings.HasSuffix(host, ".ghe.com") {
+		return ""
+	}
+
+	return strings.TrimPrefix(host, "api.")
+}
+
+// Backup exports the repositories into a migration archive, downloads it to
+// opts.Path, and deletes the migration. Locked repositories are unlocked once
+// the archive is downloaded, or if the backup fails or ctx is done. A stuck
+// migration is deleted and started again, see Options.StuckAfter, a migration
+// whose download failed is kept, see KeptError. Outside of Options.Window the
+// backup waits before starting a migration.
+func (c *Client) Backup(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Organization == "" {
+		return nil, errors.New("organization is required")
+	}
+
+	if opts.Path == "" {
+		return nil, errors.New("archive path is required")
+	}
+
+	res := &Result{Repositories: opts.Repositories, Path: opts.Path}
+
+	if len(res.Repositories) == 0 {
+		repos, err := c.ListRepositoryNames(ctx, opts.Organization, opts.Filter, opts.OnEvent)
+		if err != nil {
+			return res, err
+		}
+		res.Repositories = repos
+	}
+	emit(opts.OnEvent, Event{Type: RepositoriesListed, Repositories: res.Repositories})
+
+	var guard *lockGuard
+	var stuck, failures int
+
+	for {
+		res.Attempts++
+
+		if err := c.waitForWindow(ctx, opts); err != nil {
+			return res, err
+		}
+
+		id, err := c.StartMigration(ctx, opts.Organization, res.Repositories, opts.Lock)
+		if err != nil {
+			return res, err
+		}
+		res.MigrationID = id
+		emit(opts.OnEvent, Event{Type: MigrationStarted, MigrationID: id, Repositories: res.Repositories})
+
+		guard = c.guardLock(opts, res)
+
+		err = c.export(ctx, opts, res)
+		if err == nil {
+			break
+		}
+
+		var failed *MigrationFailedError
+		var backoff time.Duration
+
+		retry := false
+		if errors.Is(err, ErrMigrationStuck) {
+			stuck++
+			if retry = stuck < opts.Attempts; retry {
+				emit(opts.OnEvent, Event{Type: MigrationAbandoned, MigrationID: id, Elapsed: opts.StuckAfter, Err: err})
+			}
+		} else if errors.As(err, &failed) && failures < opts.FailedRetries {
+			backoff = opts.FailedBackoff
+			if backoff <= 0 {
+				backoff = DefaultFailedBackoff
+			}
+			backoff <<= failures
+			failures++
+
+			retry = true
+			emit(opts.OnEvent, Event{Type: MigrationFailed, MigrationID: id, Elapsed: backoff, Err: err})
+		}
+
+		// ctx may be done, clean up regardless so repositories aren't left locked
+		c.release(context.Background(), opts, res, guard)
+		c.deleteMigration(context.Background(), opts, res.MigrationID)
+
+		if !retry {
+			return res, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+
+	if err := c.download(ctx, opts, res); err != nil {
+		// keep the exported migration, so only the download has to be retried
+		c.release(context.Background(), opts, res, guard)
+		return res, &KeptError{MigrationID: res.MigrationID, Err: err}
+	}
+
+	c.release(ctx, opts, res, guard)
+	c.deleteMigration(ctx, opts, res.MigrationID)
+
+	// verify after cleanup, so repositories aren't locked any longer than needed
+	if opts.Verify {
+		if err := c.Verify(ctx, opts.Organization, opts.Path, opts.OnEvent); err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// Retry downloads the archive of migration id kept after a failed download,
+// see KeptError, and deletes the migration.
+func (c *Client) Retry(ctx context.Context, opts Options, id int64) (*Result, error) {
+	if opts.Path == "" {
+		return nil, errors.New("archive path is required")
+	}
+
+	m, _, err := c.Migrations.MigrationStatus(ctx, opts.Organization, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.GetState() != "exported" {
+		return nil, fmt.Errorf("migration %d is %s, not exported", id, m.GetState())
+	}
+
+	res := &Result{MigrationID: id, Path: opts.Path, Attempts: 1}
+	for _, r := range m.Repositories {
+		res.Repositories = append(res.Repositories, r.GetName())
+	}
+	emit(opts.OnEvent, Event{Type: RepositoriesListed, Repositories: res.Repositories})
+
+	// exported by the previous run, Elapsed is unknown
+	emit(opts.OnEvent, Event{Type: MigrationExported, MigrationID: id})
+
+	if err := c.download(ctx, opts, res); err != nil {
+		return res, &KeptError{MigrationID: id, Err: err}
+	}
+
+	c.deleteMigration(ctx, opts, id)
+
+	if opts.Verify {
+		if err := c.Verify(ctx, opts.Organization, opts.Path, opts.OnEvent); err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// export waits for the migration to be exported.
+func (c *Client) export(ctx context.Context, opts Options, res *Result) error {
+	waitCtx := ctx
+	if opts.StuckAfter > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, opts.StuckAfter)
+		defer cancel()
+	}
+
+	exportStart := time.Now()
+	if err := c.WaitForMigration(waitCtx, opts.Organization, res.MigrationID, opts.PollInterval, opts.OnEvent); err != nil {
+		if ctx.Err() == nil && waitCtx.Err() != nil {
+			return fmt.Errorf("migration %d not exported after %s: %w", res.MigrationID, opts.StuckAfter, ErrMigrationStuck)
+		}
+		return err
+	}
+	res.ExportDuration = time.Since(exportStart)
+	emit(opts.OnEvent, Event{Type: MigrationExported, MigrationID: res.MigrationID, Elapsed: res.ExportDuration})
+
+	return nil
+}
+
+// download downloads the archive of the exported migration and runs
+// Options.AfterDownload.
+func (c *Client) download(ctx context.Context, opts Options, res *Result) (err error) {
+	downloadStart := time.Now()
+	if res.Bytes, err = c.DownloadArchive(ctx, opts.Organization, res.MigrationID, opts.Path, opts.OnEvent); err != nil {
+		return err
+	}
+	res.DownloadDuration = time.Since(downloadStart)
+	emit(opts.OnEvent, Event{Type: DownloadComplete, MigrationID: res.MigrationID, Path: opts.Path, Bytes: res.Bytes})
+
+	if res.Sizes, err = ArchiveRepositories(opts.Path); err != nil {
+		return err
+	}
+
+	// GitHub sometimes exports a migration without some of its repositories
+	res.Missing = missingRepositories(res.Sizes, res.Repositories)
+	for _, r := range res.Missing {
+		emit(opts.OnEvent, Event{Type: RepositoryMissing, MigrationID: res.MigrationID, Repository: r, Path: opts.Path})
+	}
+
+	if opts.AfterDownload != nil {
+		return opts.AfterDownload(res)
+	}
+
+	return nil
+}
+
+// lockGuard unlocks the repositories of a migration once, when it is cleaned
+// up or Options.MaxLockDuration is exceeded, whichever comes first.
+type lockGuard struct {
+	once  sync.Once
+	timer *time.Timer
+
+	// expired is set by the timer, release reports it on the goroutine of
+	// the backup, so OnEvent is never called concurrently
+	mu      sync.Mutex
+	expired bool
+}
+
+func (c *Client) guardLock(opts Options, res *Result) *lockGuard {
+	g := &lockGuard{}
+
+	if opts.Lock && opts.MaxLockDuration > 0 {
+		id, repos := res.MigrationID, res.Repositories
+		g.timer = time.AfterFunc(opts.MaxLockDuration, func() {
+			g.once.Do(func() {
+				g.mu.Lock()
+				g.expired = true
+				g.mu.Unlock()
+
+				for _, r := range repos {
+					c.Migrations.UnlockRepo(context.Background(), opts.Organization, id, r)
+				}
+			})
+		})
+	}
+
+	return g
+}
+
+// release unlocks the repositories if they were locked for backup and still
+// are.
+func (c *Client) release(ctx context.Context, opts Options, res *Result, g *lockGuard) {
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+
+	if opts.Lock {
+		g.once.Do(func() {
+			c.unlock(ctx, opts, res.MigrationID, res.Repositories)
+		})
+	}
+
+	g.mu.Lock()
+	expired := g.expired
+	g.mu.Unlock()
+
+	if expired {
+		res.Degraded = true
+
+		emit(opts.OnEvent, Event{Type: LockExpired, MigrationID: res.MigrationID, Elapsed: opts.MaxLockDuration})
+		for _, r := range res.Repositories {
+			emit(opts.OnEvent, Event{Type: RepositoryUnlocked, MigrationID: res.MigrationID, Repository: r})
+		}
+	}
+}
+
+func (c *Client) deleteMigration(ctx context.Context, opts Options, id int64) {
+	c.Migrations.DeleteMigration(ctx, opts.Organization, id)
+	emit(opts.OnEvent, Event{Type: MigrationDeleted, MigrationID: id})
+}
+
+func (c *Client) unlock(ctx context.Context, opts Options, id int64, repos []string) {
+	for _, r := range repos {
+		c.Migrations.UnlockRepo(ctx, opts.Organization, id, r)
+		emit(opts.OnEvent, Event{Type: RepositoryUnlocked, MigrationID: id, Repository: r})
+	}
+}
@@ -0,0 +1,340 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+// fakeMigrations serves migrations whose states are polled in order from
+// states, one list per started migration, the last state repeats.
+type fakeMigrations struct {
+	mu sync.Mutex
+
+	states     [][]string
+	archiveURL string
+
+	started  int64
+	polls    map[int64]int
+	unlocked []string
+	deleted  []int64
+}
+
+func (f *fakeMigrations) StartMigration(ctx context.Context, org string, repos []string, opts *rest.MigrationOptions) (*rest.Migration, *rest.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.started++
+	id := f.started
+
+	return &rest.Migration{ID: &id}, nil, nil
+}
+
+func (f *fakeMigrations) MigrationStatus(ctx context.Context, org string, id int64) (*rest.Migration, *rest.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.polls == nil {
+		f.polls = map[int64]int{}
+	}
+
+	states := f.states[id-1]
+	i := f.polls[id]
+	if i >= len(states) {
+		i = len(states) - 1
+	}
+	f.polls[id]++
+
+	state := states[i]
+
+	return &rest.Migration{ID: &id, State: &state}, nil, nil
+}
+
+func (f *fakeMigrations) MigrationArchiveURL(ctx context.Context, org string, id int64) (string, error) {
+	return f.archiveURL, nil
+}
+
+func (f *fakeMigrations) UnlockRepo(ctx context.Context, org string, id int64, repo string) (*rest.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.unlocked = append(f.unlocked, repo)
+	return nil, nil
+}
+
+func (f *fakeMigrations) DeleteMigration(ctx context.Context, org string, id int64) (*rest.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.deleted = append(f.deleted, id)
+	return nil, nil
+}
+
+// fakeQuerier fails every query, backups with Options.Repositories don't list
+// them.
+type fakeQuerier struct{}
+
+func (fakeQuerier) Query(ctx context.Context, q interface{}, variables map[string]interface{}) error {
+	return errors.New("unexpected query")
+}
+
+// testArchive returns a gzipped migration archive containing repos.
+func testArchive(t *testing.T, org string, repos ...string) []byte {
+	var b bytes.Buffer
+
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+
+	for _, r := range repos {
+		data := []byte("ref: refs/heads/main\n")
+		h := &tar.Header{Name: "repositories/" + org + "/" + r + ".git/HEAD", Mode: 0644, Size: int64(len(data))}
+
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// testBackup runs a backup of repositories a and b of org with migrations
+// and the archive served by handler, returning the result, the types of the
+// events reported, and the error.
+func testBackup(t *testing.T, m *fakeMigrations, handler http.HandlerFunc, opts Options) (*Result, []EventType, error) {
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m.archiveURL = srv.URL + "/archive.tar.gz"
+
+	var events []EventType
+	opts.Organization = "org"
+	opts.Repositories = []string{"a", "b"}
+	opts.Path = filepath.Join(dir, "backup.tar.gz")
+	opts.PollInterval = time.Millisecond
+	opts.OnEvent = func(e Event) { events = append(events, e.Type) }
+
+	res, err := New(m, fakeQuerier{}, srv.Client()).Backup(context.Background(), opts)
+
+	if _, serr := os.Stat(opts.Path + ".tmp"); !os.IsNotExist(serr) {
+		t.Errorf("partial download %s.tmp left behind", opts.Path)
+	}
+
+	return res, events, err
+}
+
+func archiveHandler(archive []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}
+}
+
+func hasEvent(events []EventType, want EventType) bool {
+	for _, e := range events {
+		if e == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestBackup(t *testing.T) {
+	m := &fakeMigrations{states: [][]string{{"pending", "exporting", "exported"}}}
+
+	res, events, err := testBackup(t, m, archiveHandler(testArchive(t, "org", "a", "b")), Options{Lock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.MigrationID != 1 || res.Attempts != 1 {
+		t.Errorf("migration %d after %d attempts, want 1 after 1", res.MigrationID, res.Attempts)
+	}
+
+	if len(res.Missing) > 0 {
+		t.Errorf("missing %v, want none", res.Missing)
+	}
+
+	if want := map[string]uint64{"a": 21, "b": 21}; !reflect.DeepEqual(res.Sizes, want) {
+		t.Errorf("sizes %v, want %v", res.Sizes, want)
+	}
+
+	if want := []string{"a", "b"}; !reflect.DeepEqual(m.unlocked, want) {
+		t.Errorf("unlocked %v, want %v", m.unlocked, want)
+	}
+
+	if want := []int64{1}; !reflect.DeepEqual(m.deleted, want) {
+		t.Errorf("deleted %v, want %v", m.deleted, want)
+	}
+
+	for _, e := range []EventType{RepositoriesListed, MigrationStarted, MigrationState, MigrationExported, DownloadProgress, DownloadComplete, MigrationDeleted} {
+		if !hasEvent(events, e) {
+			t.Errorf("no %s event", e)
+		}
+	}
+}
+
+func TestBackupMissingRepository(t *testing.T) {
+	m := &fakeMigrations{states: [][]string{{"exported"}}}
+
+	res, events, err := testBackup(t, m, archiveHandler(testArchive(t, "org", "a")), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"b"}; !reflect.DeepEqual(res.Missing, want) {
+		t.Errorf("missing %v, want %v", res.Missing, want)
+	}
+
+	if !hasEvent(events, RepositoryMissing) {
+		t.Errorf("no %s event", RepositoryMissing)
+	}
+}
+
+func TestBackupFailedMigration(t *testing.T) {
+	m := &fakeMigrations{states: [][]string{{"exporting", "failed"}, {"exported"}}}
+
+	res, events, err := testBackup(t, m, archiveHandler(testArchive(t, "org", "a", "b")), Options{
+		FailedRetries: 1,
+		FailedBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.MigrationID != 2 || res.Attempts != 2 {
+		t.Errorf("migration %d after %d attempts, want 2 after 2", res.MigrationID, res.Attempts)
+	}
+
+	if want := []int64{1, 2}; !reflect.DeepEqual(m.deleted, want) {
+		t.Errorf("deleted %v, want %v", m.deleted, want)
+	}
+
+	if !hasEvent(events, MigrationFailed) {
+		t.Errorf("no %s event", MigrationFailed)
+	}
+}
+
+func TestBackupFailedMigrationWithoutRetries(t *testing.T) {
+	m := &fakeMigrations{states: [][]string{{"failed"}}}
+
+	_, _, err := testBackup(t, m, archiveHandler(nil), Options{})
+
+	var failed *MigrationFailedError
+	if !errors.As(err, &failed) || failed.MigrationID != 1 {
+		t.Fatalf("error %v, want MigrationFailedError of migration 1", err)
+	}
+
+	if want := []int64{1}; !reflect.DeepEqual(m.deleted, want) {
+		t.Errorf("deleted %v, want %v", m.deleted, want)
+	}
+}
+
+func TestBackupStuckMigration(t *testing.T) {
+	m := &fakeMigrations{states: [][]string{{"exporting"}, {"exported"}}}
+
+	res, events, err := testBackup(t, m, archiveHandler(testArchive(t, "org", "a", "b")), Options{
+		StuckAfter: 20 * time.Millisecond,
+		Attempts:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.MigrationID != 2 || res.Attempts != 2 {
+		t.Errorf("migration %d after %d attempts, want 2 after 2", res.MigrationID, res.Attempts)
+	}
+
+	if !hasEvent(events, MigrationAbandoned) {
+		t.Errorf("no %s event", MigrationAbandoned)
+	}
+}
+
+func TestBackupStuckMigrationAttempts(t *testing.T) {
+	m := &fakeMigrations{states: [][]string{{"exporting"}, {"exporting"}}}
+
+	res, _, err := testBackup(t, m, archiveHandler(nil), Options{
+		StuckAfter: 20 * time.Millisecond,
+		Attempts:   2,
+	})
+	if !errors.Is(err, ErrMigrationStuck) {
+		t.Fatalf("error %v, want %v", err, ErrMigrationStuck)
+	}
+
+	if res.Attempts != 2 {
+		t.Errorf("%d attempts, want 2", res.Attempts)
+	}
+
+	if want := []int64{1, 2}; !reflect.DeepEqual(m.deleted, want) {
+		t.Errorf("deleted %v, want %v", m.deleted, want)
+	}
+}
+
+func TestBackupDownloadFailure(t *testing.T) {
+	m := &fakeMigrations{states: [][]string{{"exported"}}}
+
+	// the connection is closed before the announced length is sent
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte("partial"))
+	}
+
+	_, _, err := testBackup(t, m, handler, Options{Lock: true})
+
+	var kept *KeptError
+	if !errors.As(err, &kept) || kept.MigrationID != 1 {
+		t.Fatalf("error %v, want KeptError of migration 1", err)
+	}
+
+	if len(m.deleted) > 0 {
+		t.Errorf("deleted %v, want the migration kept", m.deleted)
+	}
+
+	if want := []string{"a", "b"}; !reflect.DeepEqual(m.unlocked, want) {
+		t.Errorf("unlocked %v, want %v", m.unlocked, want)
+	}
+}
+
+func TestBackupDownloadStatus(t *testing.T) {
+	m := &fakeMigrations{states: [][]string{{"exported"}}}
+
+	// the signed archive URL expired
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+	}
+
+	_, _, err := testBackup(t, m, handler, Options{})
+
+	var kept *KeptError
+	if !errors.As(err, &kept) || kept.MigrationID != 1 {
+		t.Fatalf("error %v, want KeptError of migration 1", err)
+	}
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// progressWriter counts the bytes written to it and reports them as
+// DownloadProgress events. We pass it into io.TeeReader() which will report
+// progress on each write cycle.
+type progressWriter struct {
+	total   uint64
+	size    uint64
+	onEvent func(Event)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	pw.total += uint64(n)
+	emit(pw.onEvent, Event{Type: DownloadProgress, Bytes: pw.total, Size: pw.size})
+	return n, nil
+}
+
+// DownloadArchive downloads the archive of migration id to path and returns
+// its size.
+func (c *Client) DownloadArchive(ctx context.Context, org string, id int64, path string, onEvent func(Event)) (uint64, error) {
+	url, err := c.Migrations.MigrationArchiveURL(ctx, org, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.DownloadFile(ctx, path, url, onEvent)
+}
+
+// DownloadFile will download a url to a local file. It's efficient because it will
+// write as it downloads and not load the whole file into memory. We pass an io.TeeReader
+// into Copy() to report progress on the download. The partial download is removed if
+// it fails or ctx is done.
+func (c *Client) DownloadFile(ctx context.Context, filepath string, url string, onEvent func(Event)) (uint64, error) {
+
+	// Create the file, but give it a tmp file extension, this means we won't overwrite a
+	// file until it's downloaded, but we'll remove the tmp extension once downloaded.
+	out, err := os.Create(filepath + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+
+	// Get the data
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		out.Close()
+		os.Remove(filepath + ".tmp")
+		return 0, err
+	}
+
+	resp, err := c.Download.Do(req)
+	if err != nil {
+		out.Close()
+		os.Remove(filepath + ".tmp")
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// an expired or invalid signed URL returns an error page, not the archive
+	if resp.StatusCode != http.StatusOK {
+		out.Close()
+		os.Remove(filepath + ".tmp")
+		return 0, fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	// Create our progress reporter and pass it to be used alongside our writer
+	counter := &progressWriter{onEvent: onEvent}
+	if resp.ContentLength > 0 {
+		counter.size = uint64(resp.ContentLength)
+	}
+	if _, err = io.Copy(out, io.TeeReader(resp.Body, counter)); err != nil {
+		out.Close()
+		os.Remove(filepath + ".tmp")
+		return 0, err
+	}
+
+	// Close the file without defer so it can happen before Rename()
+	out.Close()
+
+	if err = os.Rename(filepath+".tmp", filepath); err != nil {
+		return 0, err
+	}
+	return counter.total, nil
+}
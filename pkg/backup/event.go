@@ -0,0 +1,61 @@
+package backup
+
+import "time"
+
+// EventType identifies a step of a backup.
+type EventType string
+
+// Event types in the order they occur during a backup.
+const (
+	RepositoriesPage   EventType = "repositories_page"
+	RepositoriesListed EventType = "repositories_listed"
+	WindowWait         EventType = "window_wait"
+	MigrationStarted   EventType = "migration_started"
+	MigrationState     EventType = "migration_state"
+	MigrationAbandoned EventType = "migration_abandoned"
+	MigrationFailed    EventType = "migration_failed"
+	MigrationExported  EventType = "migration_exported"
+	LockExpired        EventType = "lock_expired"
+	DownloadProgress   EventType = "download_progress"
+	DownloadComplete   EventType = "download_complete"
+	RepositoryMissing  EventType = "repository_missing"
+	RepositoryUnlocked EventType = "repository_unlocked"
+	MigrationDeleted   EventType = "migration_deleted"
+	RepositoryVerified EventType = "repository_verified"
+)
+
+// Event reports the progress of a backup, only the fields relevant to its
+// type are set. LockExpired and the RepositoryUnlocked events following it
+// are reported once the backup releases the lock, the repositories were
+// unlocked when it expired.
+type Event struct {
+	Type EventType
+
+	MigrationID  int64
+	State        string
+	Repository   string
+	Repositories []string
+
+	// Page and Count of a RepositoriesPage event
+	Page  int
+	Count int
+
+	// Bytes transferred of Size, 0 if unknown
+	Bytes uint64
+	Size  uint64
+
+	Path string
+
+	// Elapsed of the migration, or the time to wait of a MigrationFailed or
+	// WindowWait event
+	Elapsed time.Duration
+
+	// Err of a failed RepositoryVerified event
+	Err error
+}
+
+func emit(onEvent func(Event), e Event) {
+	if onEvent != nil {
+		onEvent(e)
+	}
+}
@@ -0,0 +1,36 @@
+package backup
+
+import (
+	"context"
+	"net/http"
+
+	rest "github.com/google/go-github/v31/github"
+	graphql "github.com/shurcooL/githubv4"
+)
+
+// Migrations starts, polls, and cleans up organization migrations, it is
+// implemented by the go-github MigrationService.
+type Migrations interface {
+	StartMigration(ctx context.Context, org string, repos []string, opts *rest.MigrationOptions) (*rest.Migration, *rest.Response, error)
+	MigrationStatus(ctx context.Context, org string, id int64) (*rest.Migration, *rest.Response, error)
+	MigrationArchiveURL(ctx context.Context, org string, id int64) (string, error)
+	UnlockRepo(ctx context.Context, org string, id int64, repo string) (*rest.Response, error)
+	DeleteMigration(ctx context.Context, org string, id int64) (*rest.Response, error)
+}
+
+// Querier runs GraphQL queries to list repositories and their refs, it is
+// implemented by the githubv4 Client.
+type Querier interface {
+	Query(ctx context.Context, q interface{}, variables map[string]interface{}) error
+}
+
+// Downloader fetches migration archives, it is implemented by http.Client.
+type Downloader interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+var (
+	_ Migrations = (*rest.MigrationService)(nil)
+	_ Querier    = (*graphql.Client)(nil)
+	_ Downloader = (*http.Client)(nil)
+)
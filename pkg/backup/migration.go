@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+// StartMigration starts exporting repos of org into a migration archive.
+func (c *Client) StartMigration(ctx context.Context, org string, repos []string, lock bool) (int64, error) {
+	m, _, err := c.Migrations.StartMigration(
+		ctx,
+		org,
+		repos,
+		&rest.MigrationOptions{
+			LockRepositories:   lock,
+			ExcludeAttachments: true,
+		},
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return m.GetID(), nil
+}
+
+// WaitForMigration polls the migration state every interval until it is
+// exported or ctx is done. A failed migration returns a MigrationFailedError.
+func (c *Client) WaitForMigration(ctx context.Context, org string, id int64, interval time.Duration, onEvent func(Event)) error {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	start := time.Now()
+
+	for {
+		exported, state, err := c.migrationStatus(ctx, org, id)
+
+		// report the failed state before its error
+		if state != "" {
+			emit(onEvent, Event{Type: MigrationState, MigrationID: id, State: state, Elapsed: time.Since(start)})
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if exported {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (c *Client) migrationStatus(ctx context.Context, org string, id int64) (exported bool, state string, err error) {
+	status, _, err := c.Migrations.MigrationStatus(
+		ctx,
+		org,
+		id,
+	)
+
+	if err != nil {
+		return false, "", err
+	}
+
+	s := status.GetState()
+
+	if s == "failed" {
+		return false, s, newMigrationFailedError(status)
+	}
+
+	return s == "exported", s, nil
+}
+
+// MigrationFailedError is returned if GitHub failed to export a migration.
+// The API doesn't report the reason or which repository caused it, the GUID
+// identifies the migration to GitHub Support.
+type MigrationFailedError struct {
+	MigrationID  int64
+	GUID         string
+	Repositories []string
+
+	// Elapsed between creating the migration and its failure, 0 if unknown
+	Elapsed time.Duration
+}
+
+func newMigrationFailedError(m *rest.Migration) *MigrationFailedError {
+	e := &MigrationFailedError{MigrationID: m.GetID(), GUID: m.GetGUID()}
+
+	for _, r := range m.Repositories {
+		e.Repositories = append(e.Repositories, r.GetName())
+	}
+
+	created, cerr := time.Parse(time.RFC3339, m.GetCreatedAt())
+	updated, uerr := time.Parse(time.RFC3339, m.GetUpdatedAt())
+	if cerr == nil && uerr == nil {
+		e.Elapsed = updated.Sub(created)
+	}
+
+	return e
+}
+
+func (e *MigrationFailedError) Error() string {
+	msg := fmt.Sprintf("migration %d failed", e.MigrationID)
+	if e.Elapsed > 0 {
+		msg += fmt.Sprintf(" after %s", e.Elapsed)
+	}
+	if len(e.Repositories) > 0 {
+		msg += fmt.Sprintf(" exporting %d repositories", len(e.Repositories))
+	}
+
+	msg += ", GitHub doesn't report why"
+	if e.GUID != "" {
+		msg += ", contact GitHub Support with migration GUID " + e.GUID
+	}
+
+	return msg
+}
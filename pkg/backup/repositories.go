@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"context"
+	"strings"
+
+	graphql "github.com/shurcooL/githubv4"
+)
+
+// Repository is a repository listed with ListRepositoryDetails.
+type Repository struct {
+	Name       string
+	IsArchived bool
+	IsFork     bool
+
+	// IsEmpty if the repository has no commits
+	IsEmpty bool
+
+	// Visibility is PUBLIC, PRIVATE, or INTERNAL
+	Visibility string
+
+	// DiskUsage in kilobytes
+	DiskUsage int
+	PushedAt  graphql.DateTime
+
+	// LockReason of a locked repository, e.g. MIGRATING
+	IsLocked   bool
+	LockReason string
+}
+
+// RepositoryFilter selects the repositories to list. Archived repositories
+// and forks are filtered by the API, visibility once listed.
+type RepositoryFilter struct {
+	ExcludeArchived bool
+	ExcludeForks    bool
+
+	// Visibility of the repositories to list: public, private, or internal.
+	// Default: all
+	Visibility string
+}
+
+// repositoriesQuery lists the repositories an organization, or a user with
+// UserMigrations, owns.
+type repositoriesQuery struct {
+	RepositoryOwner struct {
+		Repositories struct {
+			PageInfo struct {
+				EndCursor   graphql.String
+				HasNextPage bool
+			}
+			Nodes []Repository
+		} `graphql:"repositories(first: 100, after: $page, ownerAffiliations: OWNER, isArchived: $isArchived, isFork: $isFork, orderBy: {field: NAME, direction: ASC})"`
+	} `graphql:"repositoryOwner(login: $login)"`
+}
+
+// repositoryCountQuery counts the repositories repositoriesQuery lists,
+// before filtering by visibility.
+type repositoryCountQuery struct {
+	RepositoryOwner struct {
+		Repositories struct {
+			TotalCount int
+		} `graphql:"repositories(ownerAffiliations: OWNER, isArchived: $isArchived, isFork: $isFork)"`
+	} `graphql:"repositoryOwner(login: $login)"`
+}
+
+// CountRepositories returns the number of repositories owned by org that
+// match filter, before filtering by visibility, with a single request.
+func (c *Client) CountRepositories(ctx context.Context, org string, filter RepositoryFilter) (int, error) {
+	var query repositoryCountQuery
+
+	if err := c.GraphQL.Query(ctx, &query, filterVariables(org, filter)); err != nil {
+		return 0, err
+	}
+
+	return query.RepositoryOwner.Repositories.TotalCount, nil
+}
+
+// filterVariables returns the query variables of the filters the API
+// applies, false lists only repositories that aren't, null all of them.
+func filterVariables(org string, filter RepositoryFilter) map[string]interface{} {
+	variables := map[string]interface{}{
+		"login":      graphql.String(org),
+		"isArchived": (*graphql.Boolean)(nil),
+		"isFork":     (*graphql.Boolean)(nil),
+	}
+
+	if filter.ExcludeArchived {
+		variables["isArchived"] = graphql.NewBoolean(false)
+	}
+	if filter.ExcludeForks {
+		variables["isFork"] = graphql.NewBoolean(false)
+	}
+
+	return variables
+}
+
+// LockedRepositories returns the repositories of names owned by org that are
+// locked, with the reason, e.g. MIGRATING.
+func (c *Client) LockedRepositories(ctx context.Context, org string, names []string) (map[string]string, error) {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[strings.ToLower(name)] = true
+	}
+
+	locked := map[string]string{}
+
+	err := c.ListRepositoryPages(ctx, org, RepositoryFilter{}, "", func(repos []Repository, _ string) error {
+		for _, r := range repos {
+			if r.IsLocked && wanted[strings.ToLower(r.Name)] {
+				locked[r.Name] = r.LockReason
+			}
+		}
+		return nil
+	}, nil)
+
+	return locked, err
+}
+
+// ListRepositories returns the names of all repositories owned by org, an
+// organization or user login.
+func (c *Client) ListRepositories(ctx context.Context, org string, onEvent func(Event)) ([]string, error) {
+	return c.ListRepositoryNames(ctx, org, RepositoryFilter{}, onEvent)
+}
+
+// ListRepositoryNames returns the names of the repositories owned by org
+// that match filter.
+func (c *Client) ListRepositoryNames(ctx context.Context, org string, filter RepositoryFilter, onEvent func(Event)) ([]string, error) {
+	repositories, err := c.ListRepositoryDetails(ctx, org, filter, onEvent)
+
+	repos := make([]string, 0, len(repositories))
+	for _, repo := range repositories {
+		repos = append(repos, repo.Name)
+	}
+
+	return repos, err
+}
+
+// ListRepositoryDetails returns the repositories owned by org that match
+// filter, sorted by name.
+func (c *Client) ListRepositoryDetails(ctx context.Context, org string, filter RepositoryFilter, onEvent func(Event)) ([]Repository, error) {
+	var repositories []Repository
+
+	err := c.ListRepositoryPages(ctx, org, filter, "", func(repos []Repository, _ string) error {
+		repositories = append(repositories, repos...)
+		return nil
+	}, onEvent)
+
+	return repositories, err
+}
+
+// ListRepositoryPages lists the repositories owned by org that match filter
+// page by page, sorted by name, starting after cursor, or with the first page
+// if it's empty. onPage is called with the repositories of every page and the
+// cursor to continue after it, so an interrupted listing can be resumed.
+func (c *Client) ListRepositoryPages(ctx context.Context, org string, filter RepositoryFilter, cursor string, onPage func(repos []Repository, cursor string) error, onEvent func(Event)) error {
+	variables := filterVariables(org, filter)
+	variables["page"] = (*graphql.String)(nil)
+	if cursor != "" {
+		variables["page"] = graphql.NewString(graphql.String(cursor))
+	}
+
+	for page := 1; ; page++ {
+		var query repositoriesQuery
+		if err := c.GraphQL.Query(ctx, &query, variables); err != nil {
+			return err
+		}
+
+		var repos []Repository
+		for _, repo := range query.RepositoryOwner.Repositories.Nodes {
+			if filter.Visibility == "" || strings.EqualFold(repo.Visibility, filter.Visibility) {
+				repos = append(repos, repo)
+			}
+		}
+		emit(onEvent, Event{
+			Type:  RepositoriesPage,
+			Page:  page,
+			Count: len(query.RepositoryOwner.Repositories.Nodes),
+		})
+
+		end := query.RepositoryOwner.Repositories.PageInfo.EndCursor
+		if err := onPage(repos, string(end)); err != nil {
+			return err
+		}
+
+		// break on last page
+		if !query.RepositoryOwner.Repositories.PageInfo.HasNextPage {
+			return nil
+		}
+
+		variables["page"] = graphql.NewString(end)
+	}
+}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+// userMigrations implements Migrations with the user migrations API, which
+// exports the repositories of the authenticated user. The org arguments are
+// ignored.
+type userMigrations struct {
+	s *rest.MigrationService
+}
+
+// UserMigrations returns Migrations for the repositories of the authenticated
+// user instead of an organization, e.g.
+//
+//	c := backup.NewClient(httpClient, download)
+//	c.Migrations = backup.UserMigrations(c.REST.Migrations)
+//
+// Options.Organization is then the login of the user.
+func UserMigrations(s *rest.MigrationService) Migrations {
+	return &userMigrations{s: s}
+}
+
+func (u *userMigrations) StartMigration(ctx context.Context, org string, repos []string, opts *rest.MigrationOptions) (*rest.Migration, *rest.Response, error) {
+	var userOpts *rest.UserMigrationOptions
+	if opts != nil {
+		userOpts = &rest.UserMigrationOptions{
+			LockRepositories:   opts.LockRepositories,
+			ExcludeAttachments: opts.ExcludeAttachments,
+		}
+	}
+
+	m, resp, err := u.s.StartUserMigration(ctx, repos, userOpts)
+	return FromUserMigration(m), resp, err
+}
+
+func (u *userMigrations) MigrationStatus(ctx context.Context, org string, id int64) (*rest.Migration, *rest.Response, error) {
+	m, resp, err := u.s.UserMigrationStatus(ctx, id)
+	return FromUserMigration(m), resp, err
+}
+
+func (u *userMigrations) MigrationArchiveURL(ctx context.Context, org string, id int64) (string, error) {
+	return u.s.UserMigrationArchiveURL(ctx, id)
+}
+
+func (u *userMigrations) UnlockRepo(ctx context.Context, org string, id int64, repo string) (*rest.Response, error) {
+	return u.s.UnlockUserRepo(ctx, id, repo)
+}
+
+func (u *userMigrations) DeleteMigration(ctx context.Context, org string, id int64) (*rest.Response, error) {
+	return u.s.DeleteUserMigration(ctx, id)
+}
+
+// FromUserMigration converts a user migration to the organization migration
+// it is equivalent to, nil for nil.
+func FromUserMigration(m *rest.UserMigration) *rest.Migration {
+	if m == nil {
+		return nil
+	}
+
+	return &rest.Migration{
+		ID:                 m.ID,
+		GUID:               m.GUID,
+		State:              m.State,
+		LockRepositories:   m.LockRepositories,
+		ExcludeAttachments: m.ExcludeAttachments,
+		URL:                m.URL,
+		CreatedAt:          m.CreatedAt,
+		UpdatedAt:          m.UpdatedAt,
+		Repositories:       m.Repositories,
+	}
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is the time of day migrations may be started in, e.g. outside of
+// business hours or a change freeze. A Start after End spans midnight.
+type Window struct {
+	// Start and End since midnight, in local time
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses a window given as HH:MM-HH:MM, e.g. 22:00-06:00.
+func ParseWindow(s string) (*Window, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid window %q, must be HH:MM-HH:MM", s)
+	}
+
+	var bounds [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q, must be HH:MM-HH:MM", s)
+		}
+
+		bounds[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	w := &Window{Start: bounds[0], End: bounds[1]}
+
+	if w.Start == w.End {
+		return nil, fmt.Errorf("invalid window %q, start and end are the same", s)
+	}
+
+	return w, nil
+}
+
+func (w *Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d",
+		int(w.Start.Hours()), int(w.Start.Minutes())%60,
+		int(w.End.Hours()), int(w.End.Minutes())%60)
+}
+
+// Until returns how long until the window opens after t, 0 if t is within it.
+func (w *Window) Until(t time.Time) time.Duration {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+
+	if w.Start < w.End && now >= w.Start && now < w.End {
+		return 0
+	}
+	if w.Start > w.End && (now >= w.Start || now < w.End) {
+		return 0
+	}
+
+	if now < w.Start {
+		return w.Start - now
+	}
+
+	// opens tomorrow
+	return 24*time.Hour - now + w.Start
+}
+
+// waitForWindow waits until opts.Window is open, if set, reporting the wait
+// as WindowWait event.
+func (c *Client) waitForWindow(ctx context.Context, opts Options) error {
+	if opts.Window == nil {
+		return nil
+	}
+
+	wait := opts.Window.Until(time.Now())
+	if wait == 0 {
+		return nil
+	}
+
+	emit(opts.OnEvent, Event{Type: WindowWait, Elapsed: wait})
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
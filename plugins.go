@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Storage stores archives in addition to the local destination.
+type Storage interface {
+	// Upload copies the archive at path to name, a slash separated path
+	// relative to the destination (e.g. <org>/<date>/<file>), and verifies
+	// the stored copy against the hex SHA-256 checksum of the archive
+	Upload(ctx context.Context, path, name, checksum string) error
+}
+
+// HoldStorage is a Storage that can exempt a stored archive from its
+// retention, e.g. during litigation.
+type HoldStorage interface {
+	// Hold sets or releases the hold on the archive with the hex SHA-256
+	// checksum
+	Hold(ctx context.Context, checksum string, hold bool) error
+}
+
+// ProbeStorage is a Storage that can check it is reachable with the
+// configured credentials, for the readiness of serve.
+type ProbeStorage interface {
+	Probe(ctx context.Context) error
+}
+
+// Notifier reports the outcome of a run.
+type Notifier interface {
+	Notify(ctx context.Context, s *Summary) error
+}
+
+var (
+	storages  []Storage
+	notifiers []Notifier
+
+	pluginKeys = map[string]bool{
+		"storage":  true,
+		"notifier": true,
+	}
+)
+
+// readPlugins reads the plugins config block, each plugin type is a command
+// or a list of commands.
+func readPlugins() {
+	storages, notifiers = nil, nil
+
+	for _, c := range hookCommands(viper.Get("plugins.storage")) {
+		storages = append(storages, &execPlugin{command: c})
+	}
+
+	for _, c := range hookCommands(viper.Get("plugins.notifier")) {
+		notifiers = append(notifiers, &execPlugin{command: c})
+	}
+}
+
+// execPlugin is an out-of-process Storage or Notifier, so proprietary
+// providers can be added without forking. It is started for every call,
+// receives a single JSON request on stdin, and may answer with a JSON
+// response on stdout, {"error": "..."} or a non-zero exit fails the call.
+// While uploading it may report the bytes uploaded as {"bytes": N} lines.
+type execPlugin struct {
+	command string
+}
+
+type pluginRequest struct {
+	Method       string   `json:"method"`
+	Organization string   `json:"organization"`
+	Path         string   `json:"path,omitempty"`
+	Name         string   `json:"name,omitempty"`
+	SHA256       string   `json:"sha256,omitempty"`
+	Summary      *Summary `json:"summary,omitempty"`
+}
+
+type pluginResponse struct {
+	Error string `json:"error"`
+
+	// SHA256 is the checksum of the stored copy, verified if returned
+	SHA256 string `json:"sha256"`
+}
+
+func (p *execPlugin) String() string {
+	return strings.Fields(p.command)[0]
+}
+
+// Upload implements Storage.
+func (p *execPlugin) Upload(ctx context.Context, path, name, checksum string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+
+	progress := newUploadProgress(p, info.Size())
+	resp, err := p.call(ctx, pluginRequest{Method: "upload", Organization: organization, Path: abs, Name: name, SHA256: checksum}, progress)
+	progress.finish()
+	if err != nil {
+		return err
+	}
+
+	if resp.SHA256 != "" {
+		return compareChecksum(p, name, checksum, resp.SHA256)
+	}
+
+	return nil
+}
+
+// Notify implements Notifier.
+func (p *execPlugin) Notify(ctx context.Context, s *Summary) error {
+	_, err := p.call(ctx, pluginRequest{Method: "notify", Organization: organization, Summary: s}, nil)
+	return err
+}
+
+// call runs the plugin with req, reporting progress lines to progress unless
+// it's nil.
+func (p *execPlugin) call(ctx context.Context, req pluginRequest, progress *transferProgress) (*pluginResponse, error) {
+	in, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	verbosef("plugin %s: %s", p, req.Method)
+
+	out := &pluginOutput{progress: progress}
+
+	cmd := shellCommand(ctx, p.command)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+
+	runErr := cmd.Run()
+	out.Write([]byte("\n"))
+
+	var resp pluginResponse
+	if b := bytes.TrimSpace(out.response.Bytes()); len(b) > 0 {
+		if err := json.Unmarshal(b, &resp); err != nil {
+			return nil, fmt.Errorf("plugin %s: invalid response: %s", p, err)
+		}
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("plugin %s: %s", p, resp.Error)
+	}
+
+	if runErr != nil {
+		return nil, fmt.Errorf("plugin %s: %s", p, runErr)
+	}
+
+	return &resp, nil
+}
+
+// pluginOutput collects the response a plugin writes to stdout, without the
+// {"bytes": N} progress lines, which are reported to progress if set.
+type pluginOutput struct {
+	response bytes.Buffer
+	line     []byte
+	progress *transferProgress
+}
+
+func (o *pluginOutput) Write(p []byte) (int, error) {
+	o.line = append(o.line, p...)
+
+	for {
+		i := bytes.IndexByte(o.line, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		o.writeLine(o.line[:i+1])
+		o.line = o.line[i+1:]
+	}
+}
+
+func (o *pluginOutput) writeLine(line []byte) {
+	var fields map[string]json.RawMessage
+	var n uint64
+
+	if o.progress != nil && json.Unmarshal(line, &fields) == nil && len(fields) == 1 &&
+		fields["bytes"] != nil && json.Unmarshal(fields["bytes"], &n) == nil {
+		o.progress.update(n, o.progress.Size)
+		return
+	}
+
+	o.response.Write(line)
+}
+
+// upload copies the archive at path to every storage. The upload fails if
+// fewer than --upload-quorum storages succeed, other failures are returned
+// as warnings.
+func upload(ctx context.Context, path string) ([]string, error) {
+	if len(storages) == 0 {
+		return nil, nil
+	}
+
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, warnings, err := uploadChecksummed(ctx, path, checksum)
+	return warnings, err
+}
+
+// uploadChecksummed is upload for an archive whose checksum is known, it
+// returns the storages the archive was uploaded to.
+func uploadChecksummed(ctx context.Context, path, checksum string) (locations, warnings []string, err error) {
+	if len(storages) == 0 {
+		return nil, nil, nil
+	}
+
+	name, err := filepath.Rel(destination, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	name = filepath.ToSlash(name)
+
+	var lastErr error
+
+	for _, s := range storages {
+		if err := s.Upload(ctx, path, name, checksum); err != nil {
+			printError(err)
+			warnings = append(warnings, "upload failed: "+redact(err.Error()))
+			lastErr = err
+			continue
+		}
+		locations = append(locations, fmt.Sprint(s))
+
+		audit(auditArchiveUploaded, organization, map[string]interface{}{"file": path, "name": name, "storage": fmt.Sprint(s)})
+		verbosef("uploaded %s to %s", name, s)
+		printf("Uploaded %s to %s\n", name, s)
+		emit(eventUploaded, map[string]interface{}{"file": path, "name": name, "storage": fmt.Sprint(s), "sha256": checksum})
+	}
+
+	quorum := uploadQuorum
+	if quorum == 0 {
+		quorum = len(storages)
+	}
+
+	if len(locations) < quorum {
+		return locations, nil, fmt.Errorf("uploaded to %d of %d storages, %d required: %w", len(locations), len(storages), quorum, lastErr)
+	}
+
+	return locations, warnings, nil
+}
+
+// compareChecksum fails if the checksum of the copy of name stored in s
+// differs from the checksum of the archive.
+func compareChecksum(s fmt.Stringer, name, want, got string) error {
+	if !strings.EqualFold(want, got) {
+		return fmt.Errorf("%s: checksum mismatch for %s: expected %s, got %s", s, name, want, got)
+	}
+
+	verbosef("%s: verified %s (sha256 %s)", s, name, got)
+
+	return nil
+}
+
+// hashChecksum returns the hex SHA-256 checksum of r.
+func hashChecksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileChecksum returns the hex SHA-256 checksum of the file at path.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return hashChecksum(f)
+}
+
+// notify reports the outcome of the run to every notifier, failures are
+// logged but don't change the outcome.
+func notify(s *Summary) {
+	for _, n := range notifiers {
+		if err := n.Notify(ctx, s); err != nil {
+			printError(err)
+		}
+	}
+}
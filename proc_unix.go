@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// processRunning reports whether a process with pid exists.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+
+	// EPERM means it exists, but belongs to another user
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// still active exit code of a running process
+const stillActive = 259
+
+// processRunning reports whether a process with pid exists.
+func processRunning(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(h)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+
+	return code == stillActive
+}
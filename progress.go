@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/stoe/ghec-backup/pkg/backup"
+)
+
+// event names emitted with --progress-format json
+const (
+	eventRepositoriesListed = "repositories_listed"
+	eventWindowWait         = "window_wait"
+	eventMigrationStarted   = "migration_started"
+	eventMigrationState     = "migration_state"
+	eventMigrationAbandoned = "migration_abandoned"
+	eventMigrationFailed    = "migration_failed"
+	eventDownloadProgress   = "download_progress"
+	eventDownloadComplete   = "download_complete"
+	eventRepositoryMissing  = "repository_missing"
+	eventRepositoryUnlocked = "repository_unlocked"
+	eventMigrationDeleted   = "migration_deleted"
+	eventLockExpired        = "lock_expired"
+	eventRepositoryVerified = "repository_verified"
+	eventUploadProgress     = "upload_progress"
+	eventUploaded           = "uploaded"
+	eventGistsArchived      = "gists_archived"
+	eventMetadataExported   = "metadata_exported"
+	eventSBOMArchived       = "sbom_archived"
+	eventInsightsExported   = "insights_exported"
+	eventSkipped            = "skipped"
+	eventDone               = "done"
+	eventError              = "error"
+)
+
+// jsonProgress reports whether progress is emitted as NDJSON events.
+func jsonProgress() bool {
+	return progressFormat == "json"
+}
+
+// emit writes a progress event as a single JSON line to stdout, so
+// orchestrators can track the run programmatically.
+func emit(name string, fields map[string]interface{}) {
+	if !jsonProgress() {
+		return
+	}
+
+	e := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339),
+		"event": name,
+	}
+
+	for k, v := range fields {
+		e[k] = v
+	}
+
+	json.NewEncoder(os.Stdout).Encode(e)
+}
+
+// reporter renders the events of a backup as text or NDJSON progress, verbose
+// log lines, and the run summary.
+type reporter struct {
+	listed       int
+	started      bool
+	state        string
+	stateSince   time.Duration
+	lastProgress time.Time
+	download     transferProgress
+	verifying    bool
+}
+
+func (r *reporter) onEvent(e backup.Event) {
+	auditEvent(organization, lock, e)
+
+	switch e.Type {
+	case backup.RepositoriesPage:
+		r.listed += e.Count
+		verbosef("repositories page %d: %d repositories (total %d)", e.Page, e.Count, r.listed)
+
+	case backup.RepositoriesListed:
+		summary.setRepositories(e.Repositories, "pending")
+		emit(eventRepositoriesListed, map[string]interface{}{"organization": organization, "count": len(e.Repositories)})
+
+	case backup.MigrationStarted:
+		summary.MigrationID = e.MigrationID
+		summary.States = nil
+		verbosef("migration %d started for %d repositories (lock: %t)", e.MigrationID, len(e.Repositories), lock)
+		emit(eventMigrationStarted, map[string]interface{}{"migration_id": e.MigrationID, "repositories": e.Repositories, "lock": lock})
+
+		printf("Creating backup archive (%v) ", e.MigrationID)
+		if !interactive {
+			printf("\n")
+		}
+		r.started = true
+		r.lastProgress = time.Now()
+
+	case backup.MigrationState:
+		if e.State != r.state {
+			if r.state == "" {
+				verbosef("migration %d state %s", e.MigrationID, e.State)
+			} else {
+				verbosef("migration %d state %s -> %s", e.MigrationID, r.state, e.State)
+
+				// the time in the previous state, as precise as the poll interval
+				d := e.Elapsed - r.stateSince
+				summary.States = append(summary.States, StateSummary{State: r.state, Seconds: d.Seconds()})
+				if interactive {
+					printf(" %s %s ", r.state, d.Round(time.Second))
+				} else {
+					printf("Creating backup archive (%v): %s for %s, now %s\n", e.MigrationID, r.state, d.Round(time.Second), e.State)
+				}
+			}
+			r.state, r.stateSince = e.State, e.Elapsed
+		}
+		emit(eventMigrationState, map[string]interface{}{"migration_id": e.MigrationID, "state": e.State})
+
+		// dots only make sense on a terminal, log files get a line periodically
+		if interactive {
+			printf(".")
+		} else if time.Since(r.lastProgress) >= progressInterval {
+			printf(
+				"Creating backup archive (%v): %s, %s elapsed\n",
+				e.MigrationID,
+				e.State,
+				e.Elapsed.Round(time.Second),
+			)
+			r.lastProgress = time.Now()
+		}
+
+	case backup.MigrationAbandoned:
+		if interactive {
+			printf("\n")
+		}
+		verbosef("migration %d abandoned: %s", e.MigrationID, e.Err)
+		printf("Migration %v not exported after %s, starting a new one\n", e.MigrationID, e.Elapsed)
+		emit(eventMigrationAbandoned, map[string]interface{}{"migration_id": e.MigrationID, "error": e.Err.Error()})
+		r.state = ""
+
+	case backup.WindowWait:
+		printf("Outside of the run window %s, waiting %s to start the migration\n", runWindow, e.Elapsed.Round(time.Second))
+		emit(eventWindowWait, map[string]interface{}{"window": runWindow.String(), "wait_seconds": e.Elapsed.Seconds()})
+
+	case backup.MigrationFailed:
+		if interactive {
+			printf("\n")
+		}
+		verbosef("migration %d failed: %s", e.MigrationID, e.Err)
+		printf("Migration %v failed, starting a new one in %s\n", e.MigrationID, e.Elapsed)
+		emit(eventMigrationFailed, map[string]interface{}{"migration_id": e.MigrationID, "error": e.Err.Error()})
+		r.state = ""
+
+	case backup.MigrationExported:
+		// retry downloads a migration exported by a previous run
+		if interactive && r.started {
+			printf(" complete\n")
+		} else {
+			printf("Creating backup archive (%v) complete\n", e.MigrationID)
+		}
+		summary.ExportSeconds = e.Elapsed.Seconds()
+		summary.setRepositoryStatus("exported")
+
+	case backup.DownloadProgress:
+		r.download.action, r.download.event = "Downloading", eventDownloadProgress
+		r.download.update(e.Bytes, e.Size)
+
+	case backup.DownloadComplete:
+		// the progress uses the same line so print a new line once it's finished downloading
+		if interactive {
+			printf("\n")
+		}
+		summary.Archive = archiveSummary(e.Path, e.Bytes)
+		emit(eventDownloadComplete, map[string]interface{}{"file": e.Path, "bytes": e.Bytes})
+
+	case backup.RepositoryMissing:
+		warning := fmt.Sprintf("%s/%s is missing from the archive", organization, e.Repository)
+		summary.Warnings = append(summary.Warnings, warning)
+		summary.setRepositoryStatusOf(e.Repository, "missing")
+		printf("%s\n", colorize(colorRed, "Warning: "+warning))
+		emit(eventRepositoryMissing, map[string]interface{}{"migration_id": e.MigrationID, "repository": e.Repository})
+
+	case backup.LockExpired:
+		warning := fmt.Sprintf("repositories unlocked after %s, before the backup finished", e.Elapsed)
+		summary.Warnings = append(summary.Warnings, warning)
+		if interactive {
+			printf("\n")
+		}
+		printf("%s\n", colorize(colorRed, "Warning: "+warning))
+		verbosef("migration %d lock expired after %s", e.MigrationID, e.Elapsed)
+		emit(eventLockExpired, map[string]interface{}{"migration_id": e.MigrationID})
+
+	case backup.RepositoryUnlocked:
+		verbosef("migration %d unlocked %s/%s", e.MigrationID, organization, e.Repository)
+		printf("%v/%v unlocked\n", organization, e.Repository)
+		emit(eventRepositoryUnlocked, map[string]interface{}{"migration_id": e.MigrationID, "repository": e.Repository})
+
+	case backup.MigrationDeleted:
+		verbosef("migration %d deleted", e.MigrationID)
+		printf("Cleaning up (%v) complete\n", e.MigrationID)
+		emit(eventMigrationDeleted, map[string]interface{}{"migration_id": e.MigrationID})
+
+	case backup.RepositoryVerified:
+		if !r.verifying {
+			printf("Verifying %s\n", e.Path)
+			r.verifying = true
+		}
+
+		if e.Err != nil {
+			summary.setRepositoryStatusOf(e.Repository, "failed")
+			printf("  %s: %s\n", e.Repository, colorize(colorRed, e.Err.Error()))
+			verbosef("verify %s failed: %s", e.Repository, e.Err)
+			emit(eventRepositoryVerified, map[string]interface{}{"repository": e.Repository, "ok": false, "error": e.Err.Error()})
+			return
+		}
+
+		printf("  %s: %s\n", e.Repository, colorize(colorGreen, "ok"))
+		verbosef("verify %s ok", e.Repository)
+		emit(eventRepositoryVerified, map[string]interface{}{"repository": e.Repository, "ok": true})
+	}
+}
+
+// transferProgress renders the progress of the archive download or of an
+// upload to a storage.
+type transferProgress struct {
+	Total uint64
+
+	// Size is the expected total from Content-Length, 0 if unknown
+	Size uint64
+
+	// action precedes the status (e.g. Downloading), event is emitted with
+	// --progress-format json, with the storage of an upload
+	action  string
+	event   string
+	storage string
+
+	start        time.Time
+	lastProgress time.Time
+}
+
+// newUploadProgress returns the progress of uploading size bytes to s.
+func newUploadProgress(s Storage, size int64) *transferProgress {
+	return &transferProgress{
+		Size:    uint64(size),
+		action:  fmt.Sprintf("Uploading to %s", s),
+		event:   eventUploadProgress,
+		storage: fmt.Sprint(s),
+	}
+}
+
+// reader returns r counting the bytes read from it as transferred.
+func (dp *transferProgress) reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, progress: dp}
+}
+
+// finish ends the redrawn progress line, if any.
+func (dp *transferProgress) finish() {
+	if interactive && !quiet && !jsonProgress() && !dp.start.IsZero() {
+		fmt.Printf("\n")
+	}
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress *transferProgress
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.progress.update(pr.progress.Total+uint64(n), pr.progress.Size)
+	}
+
+	return n, err
+}
+
+func (dp *transferProgress) update(total, size uint64) {
+	if dp.start.IsZero() {
+		dp.start = time.Now()
+	}
+
+	dp.Total, dp.Size = total, size
+	dp.PrintProgress()
+}
+
+// PrintProgress unexported
+func (dp *transferProgress) PrintProgress() {
+	if quiet {
+		return
+	}
+
+	if jsonProgress() {
+		if time.Since(dp.lastProgress) >= time.Second || dp.done() {
+			fields := map[string]interface{}{"bytes": dp.Total, "size": dp.Size}
+			if dp.storage != "" {
+				fields["storage"] = dp.storage
+			}
+			emit(dp.event, fields)
+			dp.lastProgress = time.Now()
+		}
+		return
+	}
+
+	// without a terminal, print a plain line periodically instead of redrawing
+	if !interactive {
+		if time.Since(dp.lastProgress) >= progressInterval || dp.done() {
+			fmt.Printf("%s %s\n", dp.action, dp.status())
+			dp.lastProgress = time.Now()
+		}
+		return
+	}
+
+	// redrawing on every write cycle would flicker, limit to 10 times a second
+	if time.Since(dp.lastProgress) < 100*time.Millisecond && !dp.done() {
+		return
+	}
+	dp.lastProgress = time.Now()
+
+	// Clear the line by using a character return to go back to the start and remove
+	// the remaining characters by filling it with spaces
+	fmt.Printf("\r%s", strings.Repeat(" ", 80))
+
+	// Return again and print current status of download
+	fmt.Printf("\r%s %s", dp.action, dp.status())
+}
+
+// status renders a progress bar with percent, transfer rate, and ETA if the
+// size is known, otherwise only the bytes transferred and transfer rate.
+func (dp *transferProgress) status() string {
+	// We use the humanize package to print the bytes in a meaningful way (e.g. 10 MB)
+	elapsed := time.Since(dp.start).Seconds()
+
+	rate := uint64(0)
+	if elapsed > 0 {
+		rate = uint64(float64(dp.Total) / elapsed)
+	}
+
+	if dp.Size == 0 {
+		return fmt.Sprintf("%s %s/s", humanize.Bytes(dp.Total), humanize.Bytes(rate))
+	}
+
+	const width = 25
+
+	percent := float64(dp.Total) / float64(dp.Size)
+	if percent > 1 {
+		percent = 1
+	}
+
+	filled := int(percent * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+
+	eta := "--"
+	if rate > 0 && dp.Size > dp.Total {
+		eta = (time.Duration((dp.Size-dp.Total)/rate) * time.Second).String()
+	} else if dp.done() {
+		eta = "0s"
+	}
+
+	return fmt.Sprintf(
+		"[%s] %3.0f%% %s / %s %s/s ETA %s",
+		bar,
+		percent*100,
+		humanize.Bytes(dp.Total),
+		humanize.Bytes(dp.Size),
+		humanize.Bytes(rate),
+		eta,
+	)
+}
+
+func (dp *transferProgress) done() bool {
+	return dp.Size > 0 && dp.Total >= dp.Size
+}
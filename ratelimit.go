@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// rateLimit is a rate limit of the rate_limit API, which doesn't count
+// against it.
+type rateLimit struct {
+	Limit     int   `json:"limit"`
+	Remaining int   `json:"remaining"`
+	Reset     int64 `json:"reset"`
+}
+
+// rateLimits returns the REST (core) and GraphQL rate limits of the token,
+// nil if rate limiting is disabled, e.g. on GitHub Enterprise Server.
+func rateLimits() (map[string]rateLimit, error) {
+	var resp struct {
+		Resources map[string]rateLimit `json:"resources"`
+	}
+
+	found, err := getResource(ctx, "rate_limit", &resp)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return map[string]rateLimit{
+		"rest":    resp.Resources["core"],
+		"graphql": resp.Resources["graphql"],
+	}, nil
+}
+
+// reportRateLimits prints the remaining rate limits and what the run used of
+// them since before, and warns if it used more than --rate-limit-warn.
+func reportRateLimits(before map[string]rateLimit) {
+	after, err := rateLimits()
+	if err != nil || after == nil || before == nil {
+		verbosef("rate limits: %v", err)
+		return
+	}
+
+	summary.RateLimits = map[string]*RateLimitSummary{}
+
+	for _, api := range []string{"rest", "graphql"} {
+		b, a := before[api], after[api]
+		if a.Limit == 0 {
+			continue
+		}
+
+		// requests since the reset if the window reset during the run
+		used := b.Remaining - a.Remaining
+		if a.Reset != b.Reset {
+			used = a.Limit - a.Remaining
+		}
+
+		reset := time.Unix(a.Reset, 0).UTC()
+		summary.RateLimits[api] = &RateLimitSummary{Limit: a.Limit, Remaining: a.Remaining, Used: used, Reset: reset}
+
+		printf("Rate limit %s: %s of %s remaining, %s used, resets %s\n",
+			api,
+			humanize.Comma(int64(a.Remaining)),
+			humanize.Comma(int64(a.Limit)),
+			humanize.Comma(int64(used)),
+			reset.Local().Format("15:04:05"),
+		)
+
+		if rateLimitWarn > 0 && float64(used) > rateLimitWarn*float64(a.Limit) {
+			warning := fmt.Sprintf("the backup used %d of the %d %s rate limit, more than %.0f%%", used, a.Limit, api, rateLimitWarn*100)
+			summary.Warnings = append(summary.Warnings, warning)
+			printf("%s\n", colorize(colorRed, "Warning: "+warning))
+		}
+	}
+}
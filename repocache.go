@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stoe/ghec-backup/pkg/backup"
+)
+
+// listingResumeWindow is how long an interrupted repository listing is
+// resumed, repositories created since before its cursor would be missed.
+const listingResumeWindow = time.Hour
+
+// repositoryCache is the last repository listing of an organization, reused
+// for --repository-cache-ttl so quickly repeated runs don't page through all
+// repositories again.
+type repositoryCache struct {
+	ListedAt     time.Time               `json:"listed_at"`
+	Filter       backup.RepositoryFilter `json:"filter"`
+	Count        int                     `json:"count"`
+	Repositories []string                `json:"repositories"`
+	Empty        []string                `json:"empty,omitempty"`
+}
+
+// repositoryListing is the progress of a repository listing, kept until it
+// completes so an interrupted listing continues after the last page.
+type repositoryListing struct {
+	UpdatedAt    time.Time               `json:"updated_at"`
+	Filter       backup.RepositoryFilter `json:"filter"`
+	Cursor       string                  `json:"cursor"`
+	Repositories []string                `json:"repositories"`
+	Empty        []string                `json:"empty,omitempty"`
+}
+
+// repositoryCachePath is the state file of the cached listing of org.
+func repositoryCachePath(dest, org string) string {
+	return filepath.Join(dest, org, ".repositories.json")
+}
+
+// repositoryListingPath is the state file of an unfinished listing of org.
+func repositoryListingPath(dest, org string) string {
+	return filepath.Join(dest, org, ".repositories-listing.json")
+}
+
+// listRepositories returns the repositories of the organization that match
+// --exclude-archived, --exclude-forks, and --visibility, and without
+// --include-empty the empty repositories it excluded. Within
+// --repository-cache-ttl the cached listing is used, unless the number of
+// repositories changed since.
+func listRepositories(onEvent func(backup.Event)) (names, empty []string, err error) {
+	path := repositoryCachePath(destination, organization)
+
+	defer func() {
+		if includeEmpty {
+			names, empty = append(names, empty...), nil
+		}
+	}()
+
+	if repoCacheTTL <= 0 {
+		return listRepositoryPages(onEvent)
+	}
+
+	var cache repositoryCache
+	if b, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(b, &cache) == nil &&
+		cache.Filter == repoFilter && time.Since(cache.ListedAt) < repoCacheTTL {
+		// GraphQL has no conditional requests, counting is the next cheapest
+		count, err := client.CountRepositories(ctx, organization, repoFilter)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if count == cache.Count {
+			verbosef("repositories: using %s listed %s ago", path, time.Since(cache.ListedAt).Round(time.Second))
+			return cache.Repositories, cache.Empty, nil
+		}
+
+		verbosef("repositories: %d instead of %d since %s, listing them again", count, cache.Count, cache.ListedAt.Format(time.RFC3339))
+	}
+
+	count, err := client.CountRepositories(ctx, organization, repoFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if names, empty, err = listRepositoryPages(onEvent); err != nil {
+		return nil, nil, err
+	}
+
+	cache = repositoryCache{ListedAt: time.Now().UTC(), Filter: repoFilter, Count: count, Repositories: names, Empty: empty}
+
+	return names, empty, writeState(path, cache)
+}
+
+// listRepositoryPages lists the repositories page by page, recording the
+// progress after every page, and resumes a listing interrupted within
+// listingResumeWindow.
+func listRepositoryPages(onEvent func(backup.Event)) (names, empty []string, err error) {
+	path := repositoryListingPath(destination, organization)
+
+	var listing repositoryListing
+	if b, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(b, &listing) == nil &&
+		listing.Filter == repoFilter && listing.Cursor != "" && time.Since(listing.UpdatedAt) < listingResumeWindow {
+		printf("Resuming the repository listing after %d repositories\n", len(listing.Repositories))
+	} else {
+		listing = repositoryListing{Filter: repoFilter, Repositories: []string{}}
+	}
+
+	err = client.ListRepositoryPages(ctx, organization, repoFilter, listing.Cursor, func(repos []backup.Repository, cursor string) error {
+		for _, r := range repos {
+			// they add nothing to the archive, but occasionally fail the export
+			if r.IsEmpty {
+				listing.Empty = append(listing.Empty, r.Name)
+				continue
+			}
+			listing.Repositories = append(listing.Repositories, r.Name)
+		}
+		listing.Cursor, listing.UpdatedAt = cursor, time.Now().UTC()
+
+		return writeState(path, listing)
+	}, onEvent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	os.Remove(path)
+
+	return listing.Repositories, listing.Empty, nil
+}
+
+// writeState writes v as indented JSON to the state file at path.
+func writeState(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
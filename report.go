@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const markdownReport = `# Backup report: {{ .Organization }}
+
+| | |
+| --- | --- |
+| Status | {{ .Status }} |
+| Migration | {{ with .MigrationID }}{{ . }}{{ else }}-{{ end }} |
+| Started | {{ .StartedAt.Format "2006-01-02 15:04:05 MST" }} |
+| Duration | {{ duration .DurationSeconds }} |
+{{- with .Archive }}
+| Archive | ` + "`{{ .Path }}`" + ` |
+| Size | {{ bytes .Bytes }} |
+{{- end }}
+{{- with largest .Repositories }}
+
+## Largest repositories
+
+| Repository | Size | Share |
+| --- | --- | --- |
+{{- range . }}
+| {{ .Name }} | {{ bytes .Bytes }} | {{ percent .Share }} |
+{{- end }}
+{{- end }}
+
+## Repositories
+{{ range $status, $repos := byStatus .Repositories }}
+### {{ $status }} ({{ len $repos }})
+{{ range $repos }}
+- {{ .Name }}
+{{- end }}
+{{ else }}
+No repositories.
+{{ end }}
+{{- with .Errors }}
+## Errors
+{{ range . }}
+- {{ . }}
+{{- end }}
+{{ end -}}
+{{- with .Warnings }}
+## Warnings
+{{ range . }}
+- {{ . }}
+{{- end }}
+{{ end -}}
+`
+
+const htmlReport = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Backup report: {{ .Organization }}</title>
+<style>
+body { font-family: -apple-system, sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td { border: 1px solid #ddd; padding: 4px 8px; }
+</style>
+</head>
+<body>
+<h1>Backup report: {{ .Organization }}</h1>
+<table>
+<tr><td>Status</td><td>{{ .Status }}</td></tr>
+<tr><td>Migration</td><td>{{ with .MigrationID }}{{ . }}{{ else }}-{{ end }}</td></tr>
+<tr><td>Started</td><td>{{ .StartedAt.Format "2006-01-02 15:04:05 MST" }}</td></tr>
+<tr><td>Duration</td><td>{{ duration .DurationSeconds }}</td></tr>
+{{- with .Archive }}
+<tr><td>Archive</td><td><code>{{ .Path }}</code></td></tr>
+<tr><td>Size</td><td>{{ bytes .Bytes }}</td></tr>
+{{- end }}
+</table>
+{{- with largest .Repositories }}
+<h2>Largest repositories</h2>
+<table>
+{{- range . }}
+<tr><td>{{ .Name }}</td><td>{{ bytes .Bytes }}</td><td>{{ percent .Share }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+<h2>Repositories</h2>
+{{- range $status, $repos := byStatus .Repositories }}
+<h3>{{ $status }} ({{ len $repos }})</h3>
+<ul>
+{{- range $repos }}
+<li>{{ .Name }}</li>
+{{- end }}
+</ul>
+{{- else }}
+<p>No repositories.</p>
+{{- end }}
+{{- with .Errors }}
+<h2>Errors</h2>
+<ul>
+{{- range . }}
+<li>{{ . }}</li>
+{{- end }}
+</ul>
+{{- end }}
+{{- with .Warnings }}
+<h2>Warnings</h2>
+<ul>
+{{- range . }}
+<li>{{ . }}</li>
+{{- end }}
+</ul>
+{{- end }}
+</body>
+</html>
+`
+
+var reportFuncs = map[string]interface{}{
+	"bytes": humanize.Bytes,
+	"duration": func(seconds float64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+	"percent": func(share float64) string {
+		return fmt.Sprintf("%.1f%%", share*100)
+	},
+	// the 10 repositories with the most git data
+	"largest": func(repos []RepositorySummary) []RepositorySummary {
+		var sized []RepositorySummary
+		for _, r := range repos {
+			if r.Bytes > 0 {
+				sized = append(sized, r)
+			}
+		}
+
+		sort.Slice(sized, func(i, j int) bool { return sized[i].Bytes > sized[j].Bytes })
+		if len(sized) > 10 {
+			sized = sized[:10]
+		}
+
+		return sized
+	},
+	"byStatus": func(repos []RepositorySummary) map[string][]RepositorySummary {
+		groups := map[string][]RepositorySummary{}
+		for _, r := range repos {
+			groups[r.Status] = append(groups[r.Status], r)
+		}
+
+		for _, g := range groups {
+			sort.Slice(g, func(i, j int) bool { return g[i].Name < g[j].Name })
+		}
+
+		return groups
+	},
+}
+
+// writeReport renders a human-readable report of s to path, as HTML for
+// .html/.htm paths and Markdown otherwise.
+func writeReport(path string, s *Summary) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var render func(io.Writer, *Summary) error
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		t := htmltemplate.Must(htmltemplate.New("report").Funcs(reportFuncs).Parse(htmlReport))
+		render = func(w io.Writer, s *Summary) error { return t.Execute(w, s) }
+	default:
+		t := template.Must(template.New("report").Funcs(reportFuncs).Parse(markdownReport))
+		render = func(w io.Writer, s *Summary) error { return t.Execute(w, s) }
+	}
+
+	if err := render(f, s); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// runLockPath is the lock file held by this run, empty if none.
+var runLockPath string
+
+// acquireRunLock creates a lock file with our PID for org, so an overlapping
+// (e.g. cron) invocation doesn't start a second migration while one is still
+// exporting. Lock files of processes that are no longer running are replaced.
+func acquireRunLock(org string) error {
+	path := filepath.Join(os.TempDir(), "ghec-backup-"+strings.ToLower(org)+".lock")
+
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+
+			runLockPath = path
+			return nil
+		}
+
+		if !os.IsExist(err) {
+			return err
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && processRunning(pid) {
+			return fmt.Errorf("another backup of %s is running (pid %d), remove %s if it is stale", org, pid, path)
+		}
+
+		verbosef("removing stale lock file %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("could not acquire lock file %s", path)
+}
+
+// releaseRunLock removes the lock file of this run, if any.
+func releaseRunLock() {
+	if runLockPath != "" {
+		os.Remove(runLockPath)
+		runLockPath = ""
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// sbomPath returns the path of the SBOM archive next to the migration
+// archive, sbom.<org>.<timestamp>.tar.gz.
+func sbomPath(archive string) string {
+	return filepath.Join(filepath.Dir(archive), "sbom."+strings.TrimPrefix(filepath.Base(archive), "backup."))
+}
+
+// archiveSBOMs exports the SPDX SBOM of repos next to the migration archive
+// and uploads them to the storages. SBOMs that can't be exported are recorded
+// as warnings.
+func archiveSBOMs(ctx context.Context, archive string, repos []string) error {
+	path := sbomPath(archive)
+
+	dir, err := ioutil.TempDir("", "ghec-backup-sbom")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var warnings []string
+	var count int
+
+	for _, repo := range repos {
+		verbosef("sbom %s/%s", organization, repo)
+
+		doc, err := getSBOM(ctx, repo)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("sbom %s/%s: %s", organization, repo, err))
+			continue
+		}
+		if doc == nil {
+			verbosef("sbom %s/%s: dependency graph not enabled", organization, repo)
+			continue
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, repo+".spdx.json"), doc, 0644); err != nil {
+			return err
+		}
+		count++
+	}
+
+	if err := writeTarGz(dir, path); err != nil {
+		return fmt.Errorf("sbom: %w", err)
+	}
+
+	for _, w := range warnings {
+		printf("%s\n", colorize(colorRed, "Warning: "+w))
+	}
+	summary.Warnings = append(summary.Warnings, warnings...)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	summary.SBOM = archiveSummary(path, uint64(info.Size()))
+
+	printf("Exported %d SBOMs to %s (%s)\n", count, path, humanize.Bytes(uint64(info.Size())))
+	emit(eventSBOMArchived, map[string]interface{}{"file": path, "bytes": info.Size(), "repositories": count})
+
+	warnings, err = upload(ctx, path)
+	summary.Warnings = append(summary.Warnings, warnings...)
+
+	return err
+}
+
+// getSBOM returns the SPDX document of the dependency graph of repo, nil if
+// the dependency graph isn't enabled.
+func getSBOM(ctx context.Context, repo string) (json.RawMessage, error) {
+	var resp struct {
+		SBOM json.RawMessage `json:"sbom"`
+	}
+
+	found, err := getResource(ctx, fmt.Sprintf("repos/%s/%s/dependency-graph/sbom", organization, repo), &resp)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return resp.SBOM, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+const (
+	releaseOwner = "stoe"
+	releaseRepo  = "ghec-backup"
+)
+
+// selfUpdate replaces the running binary with the latest release after
+// verifying it against the release's checksums.txt.
+func selfUpdate() error {
+	client := rest.NewClient(downloadClient)
+	client.UserAgent = userAgent()
+
+	release, _, err := client.Repositories.GetLatestRelease(ctx, releaseOwner, releaseRepo)
+	if err != nil {
+		return err
+	}
+
+	latest := strings.TrimPrefix(release.GetTagName(), "v")
+	if latest == strings.TrimPrefix(version, "v") {
+		fmt.Printf("ghec-backup %s is up to date\n", version)
+		return nil
+	}
+
+	name := releaseArchiveName(latest)
+
+	var archiveURL, checksumsURL string
+	for _, a := range release.Assets {
+		switch a.GetName() {
+		case name:
+			archiveURL = a.GetBrowserDownloadURL()
+		case "checksums.txt":
+			checksumsURL = a.GetBrowserDownloadURL()
+		}
+	}
+
+	if archiveURL == "" {
+		return fmt.Errorf("release %s has no asset %s", release.GetTagName(), name)
+	}
+
+	if checksumsURL == "" {
+		return fmt.Errorf("release %s has no checksums.txt", release.GetTagName())
+	}
+
+	fmt.Printf("Updating ghec-backup %s to %s\n", version, latest)
+
+	archive, err := fetch(archiveURL)
+	if err != nil {
+		return err
+	}
+
+	checksums, err := fetch(checksumsURL)
+	if err != nil {
+		return err
+	}
+
+	if err := verifyChecksum(name, archive, checksums); err != nil {
+		return err
+	}
+
+	binary, err := extractBinary(name, archive)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	if err := replaceBinary(exe, binary); err != nil {
+		return err
+	}
+
+	fmt.Printf("Updated %s to %s\n", exe, latest)
+
+	return nil
+}
+
+// releaseArchiveName follows the goreleaser archive naming in .goreleaser.yml.
+func releaseArchiveName(v string) string {
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "386":
+		arch = "i386"
+	}
+
+	ext := "tar.gz"
+	if runtime.GOOS == "windows" {
+		ext = "zip"
+	}
+
+	return fmt.Sprintf("%s_%s_%s_%s.%s", releaseRepo, v, runtime.GOOS, arch, ext)
+}
+
+func fetch(url string) ([]byte, error) {
+	resp, err := downloadClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s downloading %s", resp.Status, redactURL(url))
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func verifyChecksum(name string, archive, checksums []byte) error {
+	sum := sha256.Sum256(archive)
+	got := hex.EncodeToString(sum[:])
+
+	for _, line := range strings.Split(string(checksums), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == name {
+			if fields[0] != got {
+				return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, fields[0], got)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no checksum for %s in checksums.txt", name)
+}
+
+// extractBinary returns the ghec-backup executable from a release archive.
+func extractBinary(name string, archive []byte) ([]byte, error) {
+	bin := releaseRepo
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+
+	if strings.HasSuffix(name, ".zip") {
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range zr.File {
+			if filepath.Base(f.Name) == bin {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+
+				return ioutil.ReadAll(rc)
+			}
+		}
+	} else {
+		gz, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		tr := tar.NewReader(gz)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if h.Typeflag == tar.TypeReg && filepath.Base(h.Name) == bin {
+				return ioutil.ReadAll(tr)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%s not found in %s", bin, name)
+}
+
+// replaceBinary swaps exe for binary. The running executable is moved aside
+// first, which also works on Windows where it can't be overwritten in place.
+func replaceBinary(exe string, binary []byte) error {
+	tmp := exe + ".new"
+	if err := ioutil.WriteFile(tmp, binary, 0755); err != nil {
+		return err
+	}
+
+	old := exe + ".old"
+	os.Remove(old)
+
+	if err := os.Rename(exe, old); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, exe); err != nil {
+		// restore the previous binary
+		os.Rename(old, exe)
+		return err
+	}
+
+	// fails on Windows while the old binary is still running, it's removed on
+	// the next update
+	os.Remove(old)
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// sentryEvent is the subset of the Sentry event payload we send.
+type sentryEvent struct {
+	EventID    string                 `json:"event_id"`
+	Timestamp  string                 `json:"timestamp"`
+	Level      string                 `json:"level"`
+	Platform   string                 `json:"platform"`
+	Release    string                 `json:"release"`
+	ServerName string                 `json:"server_name,omitempty"`
+	Message    string                 `json:"message"`
+	Exception  *sentryExceptions      `json:"exception,omitempty"`
+	Tags       map[string]string      `json:"tags"`
+	Extra      map[string]interface{} `json:"extra,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string           `json:"type"`
+	Value      string           `json:"value"`
+	Stacktrace sentryStacktrace `json:"stacktrace"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+// reportToSentry sends a fatal error or panic with its stack trace and the
+// run context to the project of sentry_dsn, so failures of unattended runs
+// don't go unnoticed. Delivery errors are only logged.
+func reportToSentry(level, typ string, err error, skip int) {
+	if sentryDSN == "" {
+		return
+	}
+
+	endpoint, auth, e := parseSentryDSN(sentryDSN)
+	if e != nil {
+		verbosef("sentry: %s", e)
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	host, _ := os.Hostname()
+	message := redact(err.Error())
+
+	event := sentryEvent{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Level:      level,
+		Platform:   "go",
+		Release:    "ghec-backup@" + version,
+		ServerName: host,
+		Message:    message,
+		Exception: &sentryExceptions{Values: []sentryException{{
+			Type:       typ,
+			Value:      message,
+			Stacktrace: sentryStacktrace{Frames: stackFrames(skip + 1)},
+		}}},
+		Tags: map[string]string{
+			"organization": organization,
+			"command":      command,
+			"os":           runtime.GOOS,
+		},
+	}
+
+	if summary != nil {
+		event.Extra = map[string]interface{}{"summary": summary}
+	}
+
+	b, _ := json.Marshal(event)
+
+	req, e := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(b))
+	if e != nil {
+		verbosef("sentry: %s", e)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", auth)
+
+	client := http.DefaultClient
+	if downloadClient != nil {
+		// no token, but the configured proxy and TLS settings
+		client = downloadClient
+	}
+
+	resp, e := client.Do(req)
+	if e != nil {
+		verbosef("sentry: %s", e)
+		return
+	}
+	resp.Body.Close()
+
+	verbosef("sentry: reported event %s (%s)", event.EventID, resp.Status)
+}
+
+// parseSentryDSN returns the store endpoint and auth header of a
+// https://<key>@<host>/<project> DSN.
+func parseSentryDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+
+	project := strings.TrimPrefix(u.Path, "/")
+	if u.User == nil || project == "" {
+		return "", "", fmt.Errorf("invalid sentry_dsn, expected https://<key>@<host>/<project>")
+	}
+
+	// self-hosted Sentry may be served from a path prefix
+	prefix := ""
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project)
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s, sentry_key=%s", userAgent(), u.User.Username())
+
+	return endpoint, auth, nil
+}
+
+// stackFrames returns the stack of the caller, skip frames up, oldest first
+// as Sentry expects.
+func stackFrames(skip int) []sentryFrame {
+	pc := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pc)
+
+	var frames []sentryFrame
+	it := runtime.CallersFrames(pc[:n])
+	for {
+		f, more := it.Next()
+		frames = append([]sentryFrame{{Function: f.Function, Filename: f.File, Lineno: f.Line}}, frames...)
+		if !more {
+			break
+		}
+	}
+
+	return frames
+}
+
+// reportPanic reports a panic to Sentry and panics again, deferred in main.
+func reportPanic() {
+	if r := recover(); r != nil {
+		reportToSentry("fatal", "panic", fmt.Errorf("%v", r), 2)
+		panic(r)
+	}
+}
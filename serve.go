@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/stoe/ghec-backup/pkg/backup"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+// job is a backup triggered through the server.
+type job struct {
+	ID           string     `json:"id"`
+	Organization string     `json:"organization"`
+	Repositories []string   `json:"repositories,omitempty"`
+	Status       string     `json:"status"`
+	State        string     `json:"state,omitempty"`
+	MigrationID  int64      `json:"migration_id,omitempty"`
+	Archive      string     `json:"archive,omitempty"`
+	Bytes        uint64     `json:"bytes,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	Warnings     []string   `json:"warnings,omitempty"`
+	Excluded     []string   `json:"excluded,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+// server runs backups on demand, one at a time so an organization never has
+// two migrations exporting at once.
+type server struct {
+	mu     sync.Mutex
+	jobs   map[string]*job
+	nextID int
+	queue  chan *job
+
+	// ctx is canceled on SIGTERM, stopping the running backup
+	ctx  context.Context
+	done chan struct{}
+
+	// organization backed up by default, the global one is the job's
+	organization string
+
+	// probed is the result of probing the storages for readiness, cached
+	// for storageProbeTTL
+	probeMu  sync.Mutex
+	probedAt time.Time
+	probed   map[string]string
+}
+
+const (
+	storageProbeTTL     = time.Minute
+	storageProbeTimeout = 10 * time.Second
+
+	// maxRequestBytes limits request bodies, webhook payloads are read
+	// whole to verify their signature
+	maxRequestBytes = 1 << 20
+)
+
+// serve listens on --listen for authenticated backup requests and GitHub
+// webhooks, see the readme for the endpoints.
+func serve() error {
+	if serveToken == "" {
+		return errors.New("serve_token is required to authenticate requests")
+	}
+
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := &server{
+		jobs:  map[string]*job{},
+		queue: make(chan *job, 100),
+		ctx:   serveCtx,
+		done:  make(chan struct{}),
+
+		organization: organization,
+	}
+	go s.work()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backups", s.authenticated(s.handleBackups))
+	mux.HandleFunc("/backups/", s.authenticated(s.handleJob))
+	mux.HandleFunc("/archives", s.authenticated(s.handleArchives))
+	if webhookSecret != "" {
+		mux.HandleFunc("/webhook", s.handleWebhook)
+	}
+
+	// unauthenticated, for Kubernetes probes and load balancers
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+
+	srv := &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	printf("Listening on %s\n", l.Addr())
+	sdNotify("READY=1\nSTATUS=Listening on " + l.Addr().String())
+	go sdWatchdog(serveCtx, s.alive)
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stop:
+		printf("Received %s, stopping\n", sig)
+		sdNotify("STOPPING=1")
+	}
+
+	// stop accepting requests, then cancel the running backup, which unlocks
+	// its repositories and deletes its migration before returning
+	shutdownCtx, done := context.WithTimeout(context.Background(), 10*time.Second)
+	defer done()
+	srv.Shutdown(shutdownCtx)
+
+	cancel()
+	close(s.queue)
+	<-s.done
+
+	return nil
+}
+
+// authenticated requires the serve_token as bearer token.
+func (s *server) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(serveToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// handleBackups lists jobs on GET and queues a backup on POST with an
+// optional {"organization": "...", "repositories": [...]} body.
+func (s *server) handleBackups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		jobs := make([]job, 0, len(s.jobs))
+		for _, j := range s.jobs {
+			jobs = append(jobs, *j)
+		}
+		s.mu.Unlock()
+
+		sort.Slice(jobs, func(a, b int) bool { return jobs[a].CreatedAt.After(jobs[b].CreatedAt) })
+		writeJSON(w, http.StatusOK, jobs)
+
+	case http.MethodPost:
+		var req struct {
+			Organization string   `json:"organization"`
+			Repositories []string `json:"repositories"`
+		}
+
+		if r.ContentLength != 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+
+		if req.Organization == "" {
+			req.Organization = s.organization
+		}
+
+		j, err := s.enqueue(req.Organization, req.Repositories)
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, j)
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleJob returns the status of a single job.
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/backups/")
+
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	var snapshot job
+	if ok {
+		snapshot = *j
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// handleArchives lists the archives in the destination, optionally of
+// ?organization= only.
+func (s *server) handleArchives(w http.ResponseWriter, r *http.Request) {
+	archives, err := listArchives(destination)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if org := r.URL.Query().Get("organization"); org != "" {
+		filtered := make([]archiveInfo, 0, len(archives))
+		for _, a := range archives {
+			if strings.EqualFold(a.Organization, org) {
+				filtered = append(filtered, a)
+			}
+		}
+		archives = filtered
+	}
+
+	writeJSON(w, http.StatusOK, archives)
+}
+
+// handleWebhook queues a backup of the repository of a GitHub organization
+// webhook event, signed with the webhook_secret.
+func (s *server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	// the signature can only be verified after reading the whole body
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+
+	payload, err := rest.ValidatePayload(r, []byte(webhookSecret))
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if rest.WebHookType(r) == "ping" {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "pong"})
+		return
+	}
+
+	var event struct {
+		Organization struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+		Repository struct {
+			Name string `json:"name"`
+		} `json:"repository"`
+	}
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if event.Organization.Login == "" || event.Repository.Name == "" {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored, no organization repository"})
+		return
+	}
+
+	j, err := s.enqueue(event.Organization.Login, []string{event.Repository.Name})
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// enqueue queues a backup, repositories are added to a job of org that
+// hasn't started yet, so a burst of webhook events results in one migration.
+func (s *server) enqueue(org string, repos []string) (job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.Status != "queued" || !strings.EqualFold(j.Organization, org) {
+			continue
+		}
+
+		// no repositories means all organization repositories
+		if len(repos) == 0 {
+			j.Repositories = nil
+		} else if len(j.Repositories) > 0 {
+			j.Repositories = appendMissing(j.Repositories, repos...)
+		}
+
+		return *j, nil
+	}
+
+	s.nextID++
+	j := &job{
+		ID:           strconv.Itoa(s.nextID),
+		Organization: org,
+		Repositories: repos,
+		Status:       "queued",
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	select {
+	case s.queue <- j:
+	default:
+		return job{}, errors.New("too many queued backups")
+	}
+
+	s.jobs[j.ID] = j
+	verbosef("job %s queued: %s %s", j.ID, org, strings.Join(repos, ","))
+
+	return *j, nil
+}
+
+// work runs the queued jobs one at a time, jobs still queued on shutdown are
+// canceled.
+func (s *server) work() {
+	defer close(s.done)
+
+	for j := range s.queue {
+		if s.ctx.Err() != nil {
+			s.update(j, func() { j.Status = "canceled" })
+			continue
+		}
+
+		s.run(j)
+	}
+}
+
+// alive reports whether the worker is running and the server isn't
+// deadlocked, for the systemd watchdog and /healthz.
+func (s *server) alive() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return true
+}
+
+// handleHealth reports whether the server is alive.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !s.alive() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady reports whether the server can run backups: the worker is
+// alive and the destination is writable. The last finished job is included,
+// but a failed backup doesn't make the server unready.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"worker": "ok", "destination": "ok"}
+	status := http.StatusOK
+
+	if !s.alive() {
+		checks["worker"] = "stopped"
+		status = http.StatusServiceUnavailable
+	}
+
+	if err := writable(destination); err != nil {
+		checks["destination"] = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	for name, result := range s.probeStorages() {
+		checks[name] = result
+		if result != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	res := map[string]interface{}{"status": "ok", "checks": checks}
+	if status != http.StatusOK {
+		res["status"] = "unavailable"
+	}
+
+	if last := s.lastFinished(); last != nil {
+		res["last_job"] = last
+	}
+
+	writeJSON(w, status, res)
+}
+
+// probeStorages returns "ok" or the error of probing each storage that
+// supports it, by name. Results are cached, so probes don't run for every
+// request.
+func (s *server) probeStorages() map[string]string {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+
+	if s.probed != nil && time.Since(s.probedAt) < storageProbeTTL {
+		return s.probed
+	}
+
+	probed := map[string]string{}
+	for _, st := range storages {
+		p, ok := st.(ProbeStorage)
+		if !ok {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, storageProbeTimeout)
+		if err := p.Probe(ctx); err != nil {
+			probed[fmt.Sprint(st)] = redact(err.Error())
+		} else {
+			probed[fmt.Sprint(st)] = "ok"
+		}
+		cancel()
+	}
+
+	s.probed, s.probedAt = probed, time.Now()
+
+	return probed
+}
+
+// lastFinished returns the most recently finished job, nil if none has.
+func (s *server) lastFinished() *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var last *job
+	for _, j := range s.jobs {
+		if j.FinishedAt != nil && (last == nil || j.FinishedAt.After(*last.FinishedAt)) {
+			snapshot := *j
+			last = &snapshot
+		}
+	}
+
+	return last
+}
+
+// writable checks that files can be created in dir.
+func writable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".ghec-backup-ready-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// run backs up the organization of j like a command line run, with its
+// run lock, summary, hooks, storages, and notifications.
+func (s *server) run(j *job) {
+	start := time.Now().UTC()
+	s.update(j, func() {
+		j.Status = "running"
+		j.StartedAt = &start
+	})
+
+	printf("Job %s: backing up %s\n", j.ID, j.Organization)
+
+	s.mu.Lock()
+	org, repos := j.Organization, append([]string(nil), j.Repositories...)
+	s.mu.Unlock()
+
+	// the backup uses the global organization and summary, jobs run one at a
+	// time, see work
+	organization, summary = org, nil
+
+	err := acquireRunLock(org)
+	if err == nil {
+		r := &reporter{}
+		_, err = backupOrganization(s.ctx, repos, nil, func(e backup.Event) {
+			r.onEvent(e)
+
+			switch e.Type {
+			case backup.RepositoriesListed:
+				s.update(j, func() { j.Repositories = e.Repositories })
+			case backup.MigrationStarted:
+				s.update(j, func() { j.MigrationID = e.MigrationID })
+			case backup.WindowWait:
+				s.update(j, func() { j.State = "waiting_for_window" })
+			case backup.MigrationState:
+				s.update(j, func() { j.State = e.State })
+			case backup.DownloadComplete:
+				s.update(j, func() { j.Archive, j.Bytes = e.Path, e.Bytes })
+			}
+		})
+	}
+
+	// failRun clears the summary
+	if sum := summary; sum != nil {
+		s.update(j, func() {
+			j.Warnings = append(j.Warnings, sum.Warnings...)
+			j.Excluded = sum.Excluded
+		})
+	}
+
+	if err != nil {
+		failRun(err)
+	} else {
+		releaseRunLock()
+	}
+
+	s.update(j, func() {
+		finish := time.Now().UTC()
+		j.FinishedAt = &finish
+		j.Status = "success"
+		if len(j.Warnings) > 0 {
+			j.Status = "degraded"
+		}
+		if err != nil {
+			j.Status = "failed"
+			j.Error = redact(err.Error())
+		}
+	})
+
+	if err != nil {
+		printError(fmt.Errorf("job %s: %s", j.ID, err))
+		return
+	}
+
+	printf("Job %s: backed up %s to %s (%s)\n", j.ID, org, j.Archive, time.Since(start).Round(time.Second))
+}
+
+func (s *server) update(j *job, f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f()
+}
+
+// appendMissing appends the values not yet in list.
+func appendMissing(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
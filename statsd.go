@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// sendStatsd sends the run's metrics to a (DogStatsD compatible) statsd
+// server at addr, tagged with organization and status.
+func sendStatsd(addr string, s *Summary) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tags := fmt.Sprintf("|#organization:%s,status:%s", s.Organization, s.Status)
+
+	var bytes uint64
+	if s.Archive != nil {
+		bytes = s.Archive.Bytes
+	}
+
+	metrics := []string{
+		fmt.Sprintf("ghec_backup.run.duration:%d|ms%s", int64(s.DurationSeconds*1000), tags),
+		fmt.Sprintf("ghec_backup.archive.bytes:%d|g%s", bytes, tags),
+		fmt.Sprintf("ghec_backup.repositories:%d|g%s", len(s.Repositories), tags),
+		fmt.Sprintf("ghec_backup.runs:1|c%s", tags),
+	}
+
+	if s.Status == "failed" {
+		metrics = append(metrics, fmt.Sprintf("ghec_backup.failures:1|c%s", tags))
+	}
+
+	// one datagram, metrics separated by newlines
+	_, err = conn.Write([]byte(strings.Join(metrics, "\n")))
+
+	return err
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newStorage returns the built-in storage of a --storage value, in the form
+// <type>:<location>.
+func newStorage(value string) (Storage, error) {
+	i := strings.Index(value, ":")
+	if i < 1 {
+		return nil, fmt.Errorf("invalid storage %q, must be <type>:<location>", value)
+	}
+
+	typ, location := value[:i], value[i+1:]
+	if location == "" {
+		return nil, fmt.Errorf("storage %q has no location", value)
+	}
+
+	switch typ {
+	case "restic":
+		return &resticStorage{repository: location}, nil
+	case "webdav":
+		return newWebDAVStorage(location)
+	case "gdrive":
+		return &driveStorage{folder: location}, nil
+	case "rclone":
+		if !strings.Contains(location, ":") {
+			return nil, fmt.Errorf("invalid rclone storage %q, must be rclone:<remote>:<path>", value)
+		}
+		return &rcloneStorage{remote: strings.TrimSuffix(location, "/")}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported storage type %q, must be restic, webdav, rclone, or gdrive", typ)
+}
+
+// resticStorage stores archives as snapshots of a restic repository, which
+// deduplicates and encrypts them. The repository password is read by restic
+// from RESTIC_PASSWORD or RESTIC_PASSWORD_FILE, retention is left to
+// `restic forget`.
+type resticStorage struct {
+	repository string
+}
+
+func (r *resticStorage) String() string {
+	return "restic:" + r.repository
+}
+
+// Upload implements Storage. The checksum is recorded as snapshot tag and
+// verified by dumping the archive from the snapshot.
+func (r *resticStorage) Upload(ctx context.Context, path, name, checksum string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// --stdin keeps the <org>/<date>/<file> name instead of the local path
+	cmd := exec.CommandContext(ctx, "restic",
+		"--repo", r.repository,
+		"backup", "--stdin",
+		"--stdin-filename", name,
+		"--host", "ghec-backup",
+		"--tag", "ghec-backup",
+		"--tag", "organization="+organization,
+		"--tag", "sha256="+checksum,
+	)
+	// e.g. restic forget --keep-tag label=legal-hold
+	for _, l := range labels {
+		cmd.Args = append(cmd.Args, "--tag", "label="+l)
+	}
+	cmd.Stderr = os.Stderr
+	if verbose {
+		cmd.Stdout = os.Stderr
+	}
+
+	progress := newUploadProgress(r, info.Size())
+	cmd.Stdin = progress.reader(f)
+
+	verbosef("restic %s: backup %s", r.repository, name)
+
+	err = cmd.Run()
+	progress.finish()
+	if err != nil {
+		return fmt.Errorf("%s: %s", r, err)
+	}
+
+	dump := exec.CommandContext(ctx, "restic",
+		"--repo", r.repository,
+		"dump", "--host", "ghec-backup", "--tag", "sha256="+checksum,
+		"latest", "/"+name,
+	)
+	dump.Stderr = os.Stderr
+
+	out, err := dump.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := dump.Start(); err != nil {
+		return fmt.Errorf("%s: %s", r, err)
+	}
+
+	got, err := hashChecksum(out)
+	if werr := dump.Wait(); err == nil && werr != nil {
+		err = werr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: dump: %s", r, err)
+	}
+
+	return compareChecksum(r, name, checksum, got)
+}
+
+// Hold implements HoldStorage. The snapshot is tagged legal-hold, which
+// `restic forget --keep-tag legal-hold` keeps.
+func (r *resticStorage) Hold(ctx context.Context, checksum string, hold bool) error {
+	action := "--add"
+	if !hold {
+		action = "--remove"
+	}
+
+	cmd := exec.CommandContext(ctx, "restic",
+		"--repo", r.repository,
+		"tag", "--host", "ghec-backup", "--tag", "sha256="+checksum,
+		action, "legal-hold",
+	)
+	cmd.Stderr = os.Stderr
+	if verbose {
+		cmd.Stdout = os.Stderr
+	}
+
+	verbosef("restic %s: tag %s legal-hold", r.repository, action)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", r, err)
+	}
+
+	return nil
+}
+
+// Probe implements ProbeStorage by reading the repository config, which
+// requires the password.
+func (r *resticStorage) Probe(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "restic", "--repo", r.repository, "cat", "config")
+	if _, err := cmd.Output(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("%s: %s", r, bytes.TrimSpace(e.Stderr))
+		}
+		return fmt.Errorf("%s: %s", r, err)
+	}
+
+	return nil
+}
+
+// rcloneStorage stores archives on any rclone remote (e.g. remote:path),
+// configured in rclone's own config file.
+type rcloneStorage struct {
+	remote string
+}
+
+func (r *rcloneStorage) String() string {
+	return "rclone:" + r.remote
+}
+
+// Upload implements Storage. The archive is streamed to rclone rcat, so its
+// progress can be reported, and the checksum of the stored copy is verified.
+func (r *rcloneStorage) Upload(ctx context.Context, file, name, checksum string) error {
+	target := r.remote + "/" + name
+	if strings.HasSuffix(r.remote, ":") {
+		target = r.remote + name
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "rclone", "rcat", target)
+	cmd.Stderr = os.Stderr
+	if verbose {
+		cmd.Args = append(cmd.Args, "--verbose")
+	}
+
+	progress := newUploadProgress(r, info.Size())
+	cmd.Stdin = progress.reader(f)
+
+	verbosef("rclone rcat %s", target)
+
+	err = cmd.Run()
+	progress.finish()
+	if err != nil {
+		return fmt.Errorf("%s: %s", r, err)
+	}
+
+	// remotes without SHA-256 support (most) hash a download instead
+	got, err := r.hashsum(ctx, target)
+	if err != nil {
+		verbosef("%s: %s, downloading %s to verify it", r, err, name)
+		got, err = r.hashsum(ctx, target, "--download")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", r, err)
+	}
+
+	return compareChecksum(r, name, checksum, got)
+}
+
+// Probe implements ProbeStorage by listing the root of the remote, the path
+// may not exist before the first upload.
+func (r *rcloneStorage) Probe(ctx context.Context) error {
+	root := strings.SplitN(r.remote, ":", 2)[0] + ":"
+
+	if _, err := exec.CommandContext(ctx, "rclone", "lsf", "--max-depth", "1", root).Output(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("%s: %s", r, bytes.TrimSpace(e.Stderr))
+		}
+		return fmt.Errorf("%s: %s", r, err)
+	}
+
+	return nil
+}
+
+// hashsum returns the SHA-256 checksum of target.
+func (r *rcloneStorage) hashsum(ctx context.Context, target string, flags ...string) (string, error) {
+	args := append([]string{"hashsum", "sha256", target}, flags...)
+
+	out, err := exec.CommandContext(ctx, "rclone", args...).Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("rclone hashsum: %s", bytes.TrimSpace(e.Stderr))
+		}
+		return "", err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || fields[0] == "UNSUPPORTED" {
+		return "", errors.New("no sha256 checksum")
+	}
+
+	return fields[0], nil
+}
+
+// webDAVChunkSize is the size of the chunks uploaded to Nextcloud, which
+// accepts 5 MB to 5 GB.
+const webDAVChunkSize = 64 << 20
+
+// webDAVStorage stores archives on a WebDAV server, e.g. Nextcloud, ownCloud,
+// or a NAS. Credentials are read from WEBDAV_USERNAME and WEBDAV_PASSWORD.
+type webDAVStorage struct {
+	base     *url.URL
+	username string
+	password string
+}
+
+func newWebDAVStorage(location string) (*webDAVStorage, error) {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webdav URL %q, must be http(s)://<host>/<path>", location)
+	}
+
+	if u.User != nil {
+		return nil, fmt.Errorf("webdav URL must not contain credentials, use WEBDAV_USERNAME and WEBDAV_PASSWORD")
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	return &webDAVStorage{
+		base:     u,
+		username: os.Getenv("WEBDAV_USERNAME"),
+		password: os.Getenv("WEBDAV_PASSWORD"),
+	}, nil
+}
+
+func (w *webDAVStorage) String() string {
+	return "webdav:" + w.base.String()
+}
+
+// Upload implements Storage. Large archives are uploaded in chunks to
+// Nextcloud, which limits the size of a single request, and with a single
+// streamed PUT to other servers. The stored file is downloaded again to
+// verify its checksum.
+func (w *webDAVStorage) Upload(ctx context.Context, file, name, checksum string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// create the <org>/<date> collections
+	dir := w.base.Path
+	for _, c := range strings.Split(path.Dir(name), "/") {
+		dir += "/" + c
+		if err := w.do(ctx, "MKCOL", w.url(dir), nil, 0, nil, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+
+	target := w.url(w.base.Path + "/" + name)
+	progress := newUploadProgress(w, info.Size())
+
+	if uploads, ok := w.nextcloudUploads(); ok && info.Size() > webDAVChunkSize {
+		err = w.uploadChunked(ctx, f, info.Size(), uploads, target, checksum, progress)
+	} else {
+		header := http.Header{"OC-Checksum": {"SHA256:" + checksum}}
+		err = w.do(ctx, http.MethodPut, target, progress.reader(f), info.Size(), header, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	}
+	progress.finish()
+	if err != nil {
+		return err
+	}
+
+	// WebDAV has no standard checksum property, so read the copy back
+	req, err := w.request(ctx, http.MethodGet, target, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: GET %s: %s", w, target, resp.Status)
+	}
+
+	got, err := hashChecksum(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return compareChecksum(w, name, checksum, got)
+}
+
+// Probe implements ProbeStorage with a PROPFIND of the base collection.
+func (w *webDAVStorage) Probe(ctx context.Context) error {
+	return w.do(ctx, "PROPFIND", w.url(w.base.Path), nil, 0, http.Header{"Depth": {"0"}}, http.StatusMultiStatus)
+}
+
+// nextcloudUploads returns the chunked upload collection of the user of a
+// Nextcloud .../remote.php/dav/files/<user>/... URL.
+func (w *webDAVStorage) nextcloudUploads() (string, bool) {
+	i := strings.Index(w.base.Path, "/remote.php/dav/files/")
+	if i < 0 {
+		return "", false
+	}
+
+	user := strings.SplitN(w.base.Path[i+len("/remote.php/dav/files/"):], "/", 2)[0]
+
+	return w.base.Path[:i] + "/remote.php/dav/uploads/" + user, true
+}
+
+// uploadChunked uploads with Nextcloud chunking v2: the chunks are uploaded
+// to a temporary collection and assembled by moving it to the target.
+func (w *webDAVStorage) uploadChunked(ctx context.Context, f *os.File, size int64, uploads, target, checksum string, progress *transferProgress) error {
+	dir := fmt.Sprintf("%s/ghec-backup-%d", uploads, time.Now().UnixNano())
+	header := http.Header{
+		"Destination":     {target},
+		"OC-Total-Length": {strconv.FormatInt(size, 10)},
+	}
+
+	if err := w.do(ctx, "MKCOL", w.url(dir), nil, 0, header, http.StatusCreated); err != nil {
+		return err
+	}
+
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+webDAVChunkSize {
+		length := size - offset
+		if length > webDAVChunkSize {
+			length = webDAVChunkSize
+		}
+
+		verbosef("%s: chunk %d of %s", w, n, target)
+
+		chunk := progress.reader(io.NewSectionReader(f, offset, length))
+		if err := w.do(ctx, http.MethodPut, w.url(fmt.Sprintf("%s/%05d", dir, n)), chunk, length, header, http.StatusCreated, http.StatusNoContent); err != nil {
+			// Nextcloud expires abandoned uploads, remove it right away anyway
+			w.do(context.Background(), http.MethodDelete, w.url(dir), nil, 0, nil, http.StatusNoContent)
+			return err
+		}
+	}
+
+	header.Set("OC-Checksum", "SHA256:"+checksum)
+
+	return w.do(ctx, "MOVE", w.url(dir+"/.file"), nil, 0, header, http.StatusCreated, http.StatusNoContent)
+}
+
+func (w *webDAVStorage) url(p string) string {
+	u := *w.base
+	u.Path = p
+
+	return u.String()
+}
+
+func (w *webDAVStorage) request(ctx context.Context, method, target string, body io.Reader, size int64, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	return req, nil
+}
+
+// do sends a request and fails unless the response status is one of ok.
+func (w *webDAVStorage) do(ctx context.Context, method, target string, body io.Reader, size int64, header http.Header, ok ...int) error {
+	req, err := w.request(ctx, method, target, body, size, header)
+	if err != nil {
+		return err
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: %s %s: %s", w, method, target, resp.Status)
+}
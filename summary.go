@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Summary is the machine-readable result of a run, written with --summary-json.
+type Summary struct {
+	Organization    string                       `json:"organization"`
+	MigrationID     int64                        `json:"migration_id,omitempty"`
+	Status          string                       `json:"status"`
+	Labels          []string                     `json:"labels,omitempty"`
+	StartedAt       time.Time                    `json:"started_at"`
+	FinishedAt      time.Time                    `json:"finished_at"`
+	DurationSeconds float64                      `json:"duration_seconds"`
+	ExportSeconds   float64                      `json:"export_seconds,omitempty"`
+	DownloadSeconds float64                      `json:"download_seconds,omitempty"`
+	States          []StateSummary               `json:"states,omitempty"`
+	RateLimits      map[string]*RateLimitSummary `json:"rate_limits,omitempty"`
+	Archive         *ArchiveSummary              `json:"archive,omitempty"`
+	Gists           *ArchiveSummary              `json:"gists,omitempty"`
+	Metadata        *ArchiveSummary              `json:"metadata,omitempty"`
+	SBOM            *ArchiveSummary              `json:"sbom,omitempty"`
+	Insights        *ArchiveSummary              `json:"insights,omitempty"`
+	Repositories    []RepositorySummary          `json:"repositories"`
+	Excluded        []string                     `json:"excluded,omitempty"`
+	Empty           []string                     `json:"empty,omitempty"`
+	Errors          []string                     `json:"errors,omitempty"`
+	Warnings        []string                     `json:"warnings,omitempty"`
+}
+
+// ArchiveSummary describes the downloaded archive.
+type ArchiveSummary struct {
+	Path  string `json:"path"`
+	Bytes uint64 `json:"bytes"`
+
+	// SHA256 checksum of the migration archive and the storages it was
+	// uploaded to
+	SHA256    string   `json:"sha256,omitempty"`
+	Locations []string `json:"locations,omitempty"`
+}
+
+// StateSummary is the time a migration spent in a state, e.g. pending or
+// exporting.
+type StateSummary struct {
+	State   string  `json:"state"`
+	Seconds float64 `json:"seconds"`
+}
+
+// RateLimitSummary is the rate limit of an API, rest or graphql, after the
+// run and how much of it the run used.
+type RateLimitSummary struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Used      int       `json:"used"`
+	Reset     time.Time `json:"reset"`
+}
+
+// RepositorySummary is the per-repository result of a run.
+type RepositorySummary struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+
+	// Bytes of git data in the archive, including the wiki, and their Share
+	// of the git data of all repositories
+	Bytes uint64  `json:"bytes,omitempty"`
+	Share float64 `json:"share,omitempty"`
+}
+
+// summary of the current run, nil until the backup started
+var summary *Summary
+
+func newSummary() *Summary {
+	return &Summary{
+		Organization: organization,
+		Status:       "running",
+		Labels:       labels,
+		StartedAt:    time.Now().UTC(),
+		Repositories: []RepositorySummary{},
+	}
+}
+
+// setRepositories records the repositories of the migration with status.
+func (s *Summary) setRepositories(names []string, status string) {
+	s.Repositories = make([]RepositorySummary, len(names))
+	for i, name := range names {
+		s.Repositories[i] = RepositorySummary{Name: name, Status: status}
+	}
+}
+
+// setRepositoryStatus updates the status of all repositories.
+func (s *Summary) setRepositoryStatus(status string) {
+	for i := range s.Repositories {
+		s.Repositories[i].Status = status
+	}
+}
+
+// setRepositoryStatusOf updates the status of repository name.
+func (s *Summary) setRepositoryStatusOf(name, status string) {
+	for i := range s.Repositories {
+		if s.Repositories[i].Name == name {
+			s.Repositories[i].Status = status
+		}
+	}
+}
+
+// setRepositorySizes records the size of each repository in the archive.
+func (s *Summary) setRepositorySizes(sizes map[string]uint64) {
+	var total uint64
+	lower := make(map[string]uint64, len(sizes))
+	for name, size := range sizes {
+		total += size
+		lower[strings.ToLower(name)] = size
+	}
+
+	if total == 0 {
+		return
+	}
+
+	for i := range s.Repositories {
+		size := lower[strings.ToLower(s.Repositories[i].Name)]
+		s.Repositories[i].Bytes = size
+		s.Repositories[i].Share = float64(size) / float64(total)
+	}
+}
+
+// finish completes the summary with the run's outcome and writes it to
+// --summary-json, --report, --textfile-path, and --statsd-address, if set.
+func (s *Summary) finish(err error) error {
+	s.FinishedAt = time.Now().UTC()
+	s.DurationSeconds = s.FinishedAt.Sub(s.StartedAt).Seconds()
+
+	if err != nil {
+		s.Status = "failed"
+		s.Errors = append(s.Errors, redact(err.Error()))
+	} else if len(s.Warnings) > 0 {
+		s.Status = "degraded"
+	} else {
+		s.Status = "success"
+	}
+
+	if err := saveLastRun(destination, s); err != nil {
+		return err
+	}
+
+	if err := appendCatalog(destination, s); err != nil {
+		return err
+	}
+
+	if reportPath != "" {
+		if err := writeReport(reportPath, s); err != nil {
+			return err
+		}
+	}
+
+	if textfilePath != "" {
+		if err := writeTextfile(textfilePath, s); err != nil {
+			return err
+		}
+	}
+
+	if statsdAddress != "" {
+		if err := sendStatsd(statsdAddress, s); err != nil {
+			return err
+		}
+	}
+
+	if summaryJSON == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(summaryJSON, append(b, '\n'), 0644)
+}
+
+// archiveSummary describes the archive at path with its absolute location.
+func archiveSummary(path string, size uint64) *ArchiveSummary {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	return &ArchiveSummary{Path: path, Bytes: size}
+}
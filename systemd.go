@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state (e.g. READY=1) to the service manager, a no-op unless
+// run by systemd with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		verbosef("sd_notify: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		verbosef("sd_notify: %s", err)
+	}
+}
+
+// sdWatchdog pings the systemd watchdog at half of WatchdogSec until ctx is
+// done, as long as alive reports the service healthy, so systemd restarts a
+// hung service.
+func sdWatchdog(ctx context.Context, alive func() bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	// the watchdog is for this process only, not for forked hooks or plugins
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	verbosef("sd_notify: watchdog every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if alive() {
+				sdNotify("WATCHDOG=1")
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	// interval between plain progress lines when stdout is not a terminal
+	progressInterval = 30 * time.Second
+
+	colorReset = "\033[0m"
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+)
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colorize wraps s in an ANSI color code if colored output is enabled.
+func colorize(color, s string) string {
+	if !colorOutput {
+		return s
+	}
+
+	return color + s + colorReset
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// metricLastSuccess is carried over from the previous textfile on failure, so
+// alerts can fire on its age.
+const metricLastSuccess = "ghec_backup_last_success_timestamp_seconds"
+
+// writeTextfile writes the run's metrics in the Prometheus text format for the
+// node_exporter textfile collector. It is written to a temporary file and
+// renamed, so the collector never reads a partial file.
+func writeTextfile(path string, s *Summary) error {
+	labels := fmt.Sprintf(`{organization=%q}`, s.Organization)
+
+	success := 0
+	lastSuccess := previousMetric(path, metricLastSuccess)
+	if s.Status == "success" || s.Status == "degraded" {
+		success = 1
+		lastSuccess = float64(s.FinishedAt.Unix())
+	}
+
+	var bytes uint64
+	if s.Archive != nil {
+		bytes = s.Archive.Bytes
+	}
+
+	var b strings.Builder
+	metric := func(name, typ, help string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s%s %s\n", name, help, name, typ, name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+
+	metric("ghec_backup_last_run_timestamp_seconds", "gauge", "Time the last backup finished.", float64(s.FinishedAt.Unix()))
+	metric("ghec_backup_last_run_success", "gauge", "Whether the last backup succeeded.", float64(success))
+	if lastSuccess > 0 {
+		metric(metricLastSuccess, "gauge", "Time the last successful backup finished.", lastSuccess)
+	}
+	metric("ghec_backup_duration_seconds", "gauge", "Duration of the last backup.", s.DurationSeconds)
+	metric("ghec_backup_archive_bytes", "gauge", "Size of the last backup archive.", float64(bytes))
+	metric("ghec_backup_repositories", "gauge", "Repositories in the last backup.", float64(len(s.Repositories)))
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".ghec-backup-textfile")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+
+	// TempFile creates 0600, the collector may run as another user
+	os.Chmod(tmp.Name(), 0644)
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// previousMetric returns the value of name in the textfile at path, 0 if it
+// doesn't exist.
+func previousMetric(path, name string) float64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, name+"{") && !strings.HasPrefix(line, name+" ") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if v, err := strconv.ParseFloat(fields[len(fields)-1], 64); err == nil {
+			return v
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// TokenSource describes where to fetch the token from at runtime, configured
+// via the token_source block of the config file.
+type TokenSource struct {
+	// Type is one of vault, aws, or gcp
+	Type string `mapstructure:"type"`
+
+	// Vault: Address defaults to VAULT_ADDR, Path is the secret path (e.g. secret/data/ghec-backup)
+	Address string `mapstructure:"address"`
+	Path    string `mapstructure:"path"`
+
+	// AWS Secrets Manager / GCP Secret Manager
+	SecretID string `mapstructure:"secret_id"`
+	Region   string `mapstructure:"region"`
+	Project  string `mapstructure:"project"`
+	Version  string `mapstructure:"version"`
+
+	// Field selects a key from a JSON secret, default: token
+	Field string `mapstructure:"field"`
+}
+
+// Fetch resolves the secret from the configured source.
+func (ts TokenSource) Fetch() (string, error) {
+	var (
+		secret string
+		err    error
+	)
+
+	switch ts.Type {
+	case "vault":
+		return ts.fetchVault()
+	case "aws":
+		args := []string{"secretsmanager", "get-secret-value", "--secret-id", ts.SecretID, "--query", "SecretString", "--output", "text"}
+		if ts.Region != "" {
+			args = append(args, "--region", ts.Region)
+		}
+
+		secret, err = run("aws", args...)
+	case "gcp":
+		version := ts.Version
+		if version == "" {
+			version = "latest"
+		}
+
+		args := []string{"secrets", "versions", "access", version, "--secret", ts.SecretID}
+		if ts.Project != "" {
+			args = append(args, "--project", ts.Project)
+		}
+
+		secret, err = run("gcloud", args...)
+	default:
+		return "", fmt.Errorf("unsupported token_source type %q, must be one of vault, aws, gcp", ts.Type)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	// secrets stored as JSON documents carry the token in a field
+	var doc map[string]interface{}
+	if json.Unmarshal([]byte(secret), &doc) == nil {
+		return ts.field(doc)
+	}
+
+	return secret, nil
+}
+
+func (ts TokenSource) fetchVault() (string, error) {
+	addr := ts.Address
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+
+	if addr == "" || ts.Path == "" {
+		return "", errors.New("token_source vault requires address (or VAULT_ADDR) and path")
+	}
+
+	vaultToken := os.Getenv("VAULT_TOKEN")
+	if vaultToken == "" {
+		home, _ := os.UserHomeDir()
+		b, err := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+		if err != nil {
+			return "", errors.New("token_source vault requires VAULT_TOKEN or ~/.vault-token")
+		}
+		vaultToken = strings.TrimSpace(string(b))
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(ts.Path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", vaultToken)
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault: %s reading %s", resp.Status, ts.Path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	// KV version 2 nests the secret in data.data
+	if data, ok := body.Data["data"].(map[string]interface{}); ok {
+		return ts.field(data)
+	}
+
+	return ts.field(body.Data)
+}
+
+func (ts TokenSource) field(doc map[string]interface{}) (string, error) {
+	field := ts.Field
+	if field == "" {
+		field = "token"
+	}
+
+	v, ok := doc[field].(string)
+	if !ok {
+		return "", fmt.Errorf("token_source: field %q not found in secret", field)
+	}
+
+	return v, nil
+}
+
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", name, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
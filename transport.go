@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// URLs within log lines and error messages
+	urlPattern = regexp.MustCompile(`https?://[^\s"']+`)
+
+	// GitHub tokens and credentials in Authorization headers, in case they
+	// didn't come from the token option (e.g. a token_source)
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{20,}|github_pat_[A-Za-z0-9_]{20,})\b`),
+		regexp.MustCompile(`(?i)\b((?:authorization:\s*)?(?:bearer|token|basic)\s+)[A-Za-z0-9_\-.=+/]{16,}`),
+	}
+)
+
+// userAgent identifies the tool and its version on every request.
+func userAgent() string {
+	return fmt.Sprintf("ghec-backup/%s", version)
+}
+
+// loggingTransport sets the User-Agent on every request and, with
+// --debug-http or --verbose, logs method, URL, status, and rate limit headers
+// to stderr.
+type loggingTransport struct {
+	next  http.RoundTripper
+	debug bool
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", userAgent())
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	if !t.debug {
+		return resp, err
+	}
+
+	u := redactURL(req.URL.String())
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s [http] %s %s error: %s (%s)\n", start.Format(time.RFC3339), req.Method, u, redact(err.Error()), elapsed)
+		return resp, err
+	}
+
+	rate := ""
+	if remaining := resp.Header.Get("X-RateLimit-Remaining"); remaining != "" {
+		rate = fmt.Sprintf(
+			" rate-limit: %s/%s reset %s",
+			remaining,
+			resp.Header.Get("X-RateLimit-Limit"),
+			resp.Header.Get("X-RateLimit-Reset"),
+		)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s [http] %s %s %s (%s)%s\n", start.Format(time.RFC3339), req.Method, u, resp.Status, elapsed, rate)
+
+	return resp, err
+}
+
+// redactURL strips query values that carry credentials, e.g. the signatures
+// of pre-signed archive URLs.
+func redactURL(raw string) string {
+	i := strings.Index(raw, "?")
+	if i < 0 {
+		return raw
+	}
+
+	params := strings.Split(raw[i+1:], "&")
+	for n, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		key := strings.ToLower(kv[0])
+
+		if len(kv) == 2 && (strings.Contains(key, "sig") ||
+			strings.Contains(key, "token") ||
+			strings.Contains(key, "credential")) {
+			params[n] = kv[0] + "=REDACTED"
+		}
+	}
+
+	return raw[:i+1] + strings.Join(params, "&")
+}
+
+// redact scrubs the token, other GitHub tokens, and credentials in URL query
+// values from s, so it can be logged or shown in an error.
+func redact(s string) string {
+	if len(token) >= 4 {
+		s = strings.Replace(s, token, "REDACTED", -1)
+	}
+
+	s = secretPatterns[0].ReplaceAllString(s, "REDACTED")
+	s = secretPatterns[1].ReplaceAllString(s, "${1}REDACTED")
+
+	return urlPattern.ReplaceAllStringFunc(s, redactURL)
+}
+
+// printError prints err to stderr with secrets redacted.
+func printError(err error) {
+	fmt.Fprintf(os.Stderr, "error: %s\n", redact(err.Error()))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// trendWidth is the width of the largest archive's bar
+const trendWidth = 40
+
+// report prints the report named kind, supported: trend of the successful
+// and degraded runs. The attestation report is written by attest.
+func report(kind string) error {
+	switch kind {
+	case "trend":
+		all, err := readCatalog(destination, organization)
+		if err != nil {
+			return err
+		}
+
+		// failed runs have no archive to chart or compare against
+		var entries []catalogEntry
+		for _, e := range all {
+			if (e.Status == "success" || e.Status == "degraded") && e.Bytes > 0 {
+				entries = append(entries, e)
+			}
+		}
+
+		if len(entries) == 0 {
+			return fmt.Errorf("no successful backups of %s in %s", organization, catalogPath(destination))
+		}
+
+		if format == "csv" {
+			return writeTrendCSV(os.Stdout, entries)
+		}
+		return writeTrend(os.Stdout, entries)
+	case "":
+		return fmt.Errorf("report requires a report, supported: trend, attestation")
+	default:
+		return fmt.Errorf("unknown report %q, supported: trend, attestation", kind)
+	}
+}
+
+// writeTrend charts the archive size of each run with its duration and
+// repository count, so growth that outlasts the backup window stands out.
+func writeTrend(w io.Writer, entries []catalogEntry) error {
+	var largest uint64
+	for _, e := range entries {
+		if e.Bytes > largest {
+			largest = e.Bytes
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Started\tStatus\tRepositories\tDuration\tSize")
+
+	for _, e := range entries {
+		bar := ""
+		if largest > 0 {
+			bar = strings.Repeat("#", int(e.Bytes*trendWidth/largest))
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			e.StartedAt.Local().Format("2006-01-02 15:04"),
+			e.Status,
+			len(e.Repositories),
+			(time.Duration(e.DurationSeconds) * time.Second).String(),
+			humanize.Bytes(e.Bytes),
+			bar,
+		)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	first, last := entries[0], entries[len(entries)-1]
+	if len(entries) > 1 && first.Bytes > 0 {
+		_, err := fmt.Fprintf(w, "\nSize %+.1f%%, duration %s, repositories %+d over %d runs since %s\n",
+			(float64(last.Bytes)/float64(first.Bytes)-1)*100,
+			signedDuration(time.Duration(last.DurationSeconds-first.DurationSeconds)*time.Second),
+			len(last.Repositories)-len(first.Repositories),
+			len(entries),
+			first.StartedAt.Local().Format("2006-01-02"),
+		)
+		return err
+	}
+
+	return nil
+}
+
+// writeTrendCSV writes the runs as CSV for charting elsewhere.
+func writeTrendCSV(w io.Writer, entries []catalogEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"started_at", "organization", "status", "repositories", "duration_seconds", "bytes"})
+
+	for _, e := range entries {
+		cw.Write([]string{
+			e.StartedAt.Format(time.RFC3339),
+			e.Organization,
+			e.Status,
+			strconv.Itoa(len(e.Repositories)),
+			strconv.FormatFloat(e.DurationSeconds, 'f', 0, 64),
+			strconv.FormatUint(e.Bytes, 10),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// signedDuration formats d with a leading + if it's positive.
+func signedDuration(d time.Duration) string {
+	if d > 0 {
+		return "+" + d.String()
+	}
+	return d.String()
+}
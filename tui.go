@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/stoe/ghec-backup/pkg/backup"
+)
+
+// dashboard renders a backup as a full-screen view of the migration state,
+// download throughput, and recent backups, redrawn in place.
+type dashboard struct {
+	reporter
+
+	start        time.Time
+	repositories int
+	migrationID  int64
+	state        string
+	transitions  []string
+	download     transferProgress
+	phase        string
+	recent       []archiveInfo
+	lastDraw     time.Time
+}
+
+// tui runs the backup with the dashboard instead of line-based progress.
+func tui() error {
+	if !interactive {
+		return errors.New("tui requires an interactive terminal")
+	}
+
+	if verbose || jsonProgress() {
+		return errors.New("tui can't be combined with --verbose or --progress-format json")
+	}
+
+	d := &dashboard{start: time.Now(), phase: "listing repositories"}
+	d.recent, _ = listArchives(destination)
+	if len(d.recent) > 5 {
+		d.recent = d.recent[:5]
+	}
+
+	// the reporter still records the summary, its output is replaced by the dashboard
+	quiet = true
+	d.draw(true)
+	runBackup(d.onEvent)
+
+	return nil
+}
+
+func (d *dashboard) onEvent(e backup.Event) {
+	d.reporter.onEvent(e)
+
+	switch e.Type {
+	case backup.RepositoriesListed:
+		d.repositories = len(e.Repositories)
+		d.phase = "starting migration"
+	case backup.MigrationStarted:
+		d.migrationID = e.MigrationID
+		d.phase = "exporting"
+	case backup.MigrationState:
+		if e.State != d.state {
+			d.transitions = append(d.transitions, fmt.Sprintf("%s  %s", time.Now().Format("15:04:05"), e.State))
+			d.state = e.State
+		}
+	case backup.MigrationExported:
+		d.phase = "downloading"
+	case backup.DownloadProgress:
+		if d.download.start.IsZero() {
+			d.download.start = time.Now()
+		}
+		d.download.Total, d.download.Size = e.Bytes, e.Size
+	case backup.DownloadComplete:
+		d.phase = "cleaning up"
+	case backup.MigrationDeleted:
+		d.phase = "done"
+		if verify == "deep" {
+			d.phase = "verifying"
+		}
+	}
+
+	d.draw(e.Type != backup.DownloadProgress)
+}
+
+// draw redraws the screen, at most 5 times a second unless forced.
+func (d *dashboard) draw(force bool) {
+	if !force && time.Since(d.lastDraw) < 200*time.Millisecond {
+		return
+	}
+	d.lastDraw = time.Now()
+
+	var b strings.Builder
+
+	// move home and clear the screen
+	b.WriteString("\033[H\033[2J")
+
+	fmt.Fprintf(&b, "ghec-backup %s  %s\n\n", organization, colorize(colorGreen, d.phase))
+	fmt.Fprintf(&b, "  repositories  %d\n", d.repositories)
+	if d.migrationID != 0 {
+		fmt.Fprintf(&b, "  migration     %d (%s)\n", d.migrationID, d.state)
+	}
+	fmt.Fprintf(&b, "  elapsed       %s\n", time.Since(d.start).Round(time.Second))
+	if !d.download.start.IsZero() {
+		fmt.Fprintf(&b, "  download      %s\n", d.download.status())
+	}
+
+	if len(d.transitions) > 0 {
+		b.WriteString("\nMigration states\n")
+		for _, t := range d.transitions {
+			fmt.Fprintf(&b, "  %s\n", t)
+		}
+	}
+
+	if len(d.recent) > 0 {
+		b.WriteString("\nRecent backups\n")
+		for _, a := range d.recent {
+			fmt.Fprintf(&b, "  %s  %-40s %s\n", a.CreatedAt.Local().Format("2006-01-02 15:04"), a.Path, humanize.Bytes(a.Bytes))
+		}
+	}
+
+	b.WriteString("\n")
+
+	fmt.Fprint(os.Stdout, b.String())
+}
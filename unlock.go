@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/stoe/ghec-backup/pkg/backup"
+
+	rest "github.com/google/go-github/v31/github"
+)
+
+// checkLocked fails if any of repos is locked already, e.g. by a migration of
+// a run that crashed before cleaning up, which would fail the export. With
+// --force-unlock repositories locked by a migration are unlocked instead.
+func checkLocked(repos []string) error {
+	locked, err := client.LockedRepositories(ctx, organization, repos)
+	if err != nil || len(locked) == 0 {
+		return err
+	}
+
+	names := make([]string, 0, len(locked))
+	migrating := map[string]bool{}
+	for name, reason := range locked {
+		names = append(names, fmt.Sprintf("%s (%s)", name, strings.ToLower(reason)))
+		if reason == "MIGRATING" {
+			migrating[strings.ToLower(name)] = true
+		}
+	}
+	sort.Strings(names)
+
+	if !forceUnlock || len(migrating) < len(locked) {
+		return fmt.Errorf("%d repositories are locked already: %s, unlock repositories locked by a migration with --force-unlock or the unlock command", len(locked), strings.Join(names, ", "))
+	}
+
+	printf("Unlocking %d repositories locked by a previous migration\n", len(locked))
+
+	migrations, err := recentMigrations()
+	if err != nil {
+		return err
+	}
+
+	return unlockMigrations(migrations, migrating)
+}
+
+// unlockRepositories unlocks the repositories locked by migration id, or with
+// all by any recent migration of the organization, recovering from runs that
+// crashed before cleaning up.
+func unlockRepositories(id int64, all bool) error {
+	if (id == 0) == !all {
+		return errors.New("either --migration-id or --all is required")
+	}
+
+	var migrations []*rest.Migration
+
+	if all {
+		// the running backup's migration is recent too, don't unlock it mid-export
+		if err := acquireRunLock(organization); err != nil {
+			return fmt.Errorf("unlock --all would unlock the repositories of a running backup: %s", err)
+		}
+		defer releaseRunLock()
+
+		var err error
+		if migrations, err = recentMigrations(); err != nil {
+			return err
+		}
+
+		locking := 0
+		for _, m := range migrations {
+			if m.GetLockRepositories() {
+				locking++
+			}
+		}
+
+		if locking > 0 && !confirm(fmt.Sprintf("Unlock the repositories of %d recent migrations of %s?", locking, organization)) {
+			fmt.Println("Aborted")
+			return nil
+		}
+	} else {
+		m, _, err := client.Migrations.MigrationStatus(ctx, organization, id)
+		if err != nil {
+			return err
+		}
+		migrations = append(migrations, m)
+	}
+
+	return unlockMigrations(migrations, nil)
+}
+
+// recentMigrations returns the recent migrations of the organization, or of
+// --user.
+func recentMigrations() ([]*rest.Migration, error) {
+	var migrations []*rest.Migration
+
+	if user != "" {
+		page, _, err := client.REST.Migrations.ListUserMigrations(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range page {
+			migrations = append(migrations, backup.FromUserMigration(m))
+		}
+
+		return migrations, nil
+	}
+
+	opts := &rest.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.REST.Migrations.ListMigrations(ctx, organization, opts)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, page...)
+
+		if resp.NextPage == 0 {
+			return migrations, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// unlockMigrations unlocks the repositories locked by migrations, only those
+// in only unless it's nil.
+func unlockMigrations(migrations []*rest.Migration, only map[string]bool) error {
+	unlocked, failed := 0, 0
+
+	for _, m := range migrations {
+		if !m.GetLockRepositories() {
+			continue
+		}
+
+		for _, r := range m.Repositories {
+			if only != nil && !only[strings.ToLower(r.GetName())] {
+				continue
+			}
+
+			_, err := client.Migrations.UnlockRepo(ctx, organization, m.GetID(), r.GetName())
+			if err != nil {
+				// repositories that aren't locked (any longer) are not found
+				if e, ok := err.(*rest.ErrorResponse); ok && e.Response.StatusCode == 404 {
+					verbosef("migration %d: %s/%s not locked", m.GetID(), organization, r.GetName())
+					continue
+				}
+
+				failed++
+				fmt.Fprintf(os.Stderr, "%s/%s: %s\n", organization, r.GetName(), colorize(colorRed, redact(err.Error())))
+				continue
+			}
+
+			unlocked++
+			audit(auditRepositoryUnlocked, organization, map[string]interface{}{"migration_id": m.GetID(), "repository": r.GetName()})
+			verbosef("migration %d unlocked %s/%s", m.GetID(), organization, r.GetName())
+			printf("%s/%s unlocked (migration %d)\n", organization, r.GetName(), m.GetID())
+			emit(eventRepositoryUnlocked, map[string]interface{}{"migration_id": m.GetID(), "repository": r.GetName()})
+		}
+	}
+
+	printf("Unlocked %d repositories of %d migrations\n", unlocked, len(migrations))
+
+	if failed > 0 {
+		return fmt.Errorf("failed to unlock %d repositories", failed)
+	}
+
+	return nil
+}
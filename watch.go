@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/stoe/ghec-backup/pkg/backup"
+)
+
+// watch polls migration id and renders its state transitions and elapsed
+// time until it is exported or failed.
+func watch(id int64) error {
+	if id == 0 {
+		return errors.New("--migration-id is required")
+	}
+
+	m, _, err := client.Migrations.MigrationStatus(ctx, organization, id)
+	if err != nil {
+		return err
+	}
+
+	// elapsed since the migration was created, not since we started watching
+	created, err := time.Parse(time.RFC3339, m.GetCreatedAt())
+	if err != nil {
+		created = time.Now()
+	}
+
+	printf("Watching migration %d of %s (%d repositories)\n", id, organization, len(m.Repositories))
+
+	state, lastProgress := "", time.Time{}
+
+	err = client.WaitForMigration(ctx, organization, id, backup.DefaultPollInterval, func(e backup.Event) {
+		elapsed := time.Since(created).Round(time.Second)
+
+		emit(eventMigrationState, map[string]interface{}{"migration_id": id, "state": e.State})
+
+		if e.State != state {
+			// end the line refreshed in place before printing the transition
+			if interactive && state != "" {
+				printf("\n")
+			}
+
+			verbosef("migration %d state %s", id, e.State)
+			if !interactive {
+				printf("Migration %d: %s, %s elapsed\n", id, e.State, elapsed)
+			}
+
+			state, lastProgress = e.State, time.Now()
+		}
+
+		if interactive {
+			printf("\r%s", strings.Repeat(" ", 60))
+			printf("\rMigration %d: %s, %s elapsed", id, colorState(e.State), elapsed)
+		} else if time.Since(lastProgress) >= progressInterval {
+			printf("Migration %d: %s, %s elapsed\n", id, e.State, elapsed)
+			lastProgress = time.Now()
+		}
+	})
+
+	if interactive {
+		printf("\n")
+	}
+
+	return err
+}
+
+// colorState colors the terminal migration states.
+func colorState(state string) string {
+	switch state {
+	case "exported":
+		return colorize(colorGreen, state)
+	case "failed":
+		return colorize(colorRed, state)
+	}
+
+	return state
+}